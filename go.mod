@@ -3,8 +3,14 @@ module github.com/0-u-0/dugon-signal-server
 go 1.14
 
 require (
+	github.com/fxamacker/cbor/v2 v2.5.0
+	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/google/uuid v1.1.1
 	github.com/gorilla/websocket v1.4.2
 	github.com/nats-io/nats.go v1.9.2
 	github.com/spf13/viper v1.6.3
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	github.com/xeipuuv/gojsonschema v1.2.0
+	golang.org/x/crypto v0.0.0-20200323165209-0ec3e9974c59
+	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
 )
@@ -0,0 +1,52 @@
+package libs
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+)
+
+type APIKey struct {
+	Key    string
+	Secret string
+}
+
+// apiKeys authenticates application servers by basic auth with an api key/secret pair
+type apiKeys map[string]string
+
+func newAPIKeys(keys []APIKey) apiKeys {
+	secrets := make(apiKeys)
+	for _, k := range keys {
+		secrets[k.Key] = k.Secret
+	}
+	return secrets
+}
+
+func (a apiKeys) authorized(r *http.Request) (string, bool) {
+	key, secret, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	expected, ok := a[key]
+	if !ok {
+		return "", false
+	}
+	return key, subtle.ConstantTimeCompare([]byte(secret), []byte(expected)) == 1
+}
+
+// authorize answers 401 to unauthorized requests
+func (a apiKeys) authorize(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key, ok := a.authorized(r)
+	if !ok {
+		Log.Warnf("Api request %s from %s unauthorized\n", r.URL.Path, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Basic realm="dugon"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	}
+	return key, ok
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
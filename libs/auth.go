@@ -0,0 +1,147 @@
+package libs
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+type AuthConfig struct {
+	Algorithm string
+	Secret    string
+	PublicKey string
+	//only needed to issue RS256/ES256 tokens
+	PrivateKey string
+}
+
+type Authenticator struct {
+	algorithm string
+	key       interface{}
+	//nil if the server can't issue tokens
+	signingKey interface{}
+}
+
+// joinClaims is the payload of the token a client presents on upgrade
+type joinClaims struct {
+	SessionId string            `json:"sessionId"`
+	TokenId   string            `json:"tokenId"`
+	Metadata  map[string]string `json:"metadata"`
+	//nil means the default permissions
+	Permissions *Permissions `json:"permissions"`
+	jwt.StandardClaims
+}
+
+var (
+	errTokenMissing   = errors.New("token missing")
+	errTokenForbidden = errors.New("token does not grant a session")
+)
+
+func NewAuthenticator(config AuthConfig) (*Authenticator, error) {
+	a := &Authenticator{algorithm: config.Algorithm}
+
+	switch config.Algorithm {
+	case "HS256":
+		if config.Secret == "" {
+			return nil, errors.New("auth secret is empty")
+		}
+		a.key = []byte(config.Secret)
+		a.signingKey = a.key
+	case "RS256":
+		pem, err := ioutil.ReadFile(config.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		a.key, err = jwt.ParseRSAPublicKeyFromPEM(pem)
+		if err != nil {
+			return nil, err
+		}
+		if config.PrivateKey != "" {
+			pem, err = ioutil.ReadFile(config.PrivateKey)
+			if err != nil {
+				return nil, err
+			}
+			a.signingKey, err = jwt.ParseRSAPrivateKeyFromPEM(pem)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case "ES256":
+		pem, err := ioutil.ReadFile(config.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		a.key, err = jwt.ParseECPublicKeyFromPEM(pem)
+		if err != nil {
+			return nil, err
+		}
+		if config.PrivateKey != "" {
+			pem, err = ioutil.ReadFile(config.PrivateKey)
+			if err != nil {
+				return nil, err
+			}
+			a.signingKey, err = jwt.ParseECPrivateKeyFromPEM(pem)
+			if err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported auth algorithm %q", config.Algorithm)
+	}
+
+	return a, nil
+}
+
+func (a *Authenticator) verify(tokenString string) (*joinClaims, error) {
+	if tokenString == "" {
+		return nil, errTokenMissing
+	}
+
+	parser := &jwt.Parser{ValidMethods: []string{a.algorithm}}
+	claims := &joinClaims{}
+	_, err := parser.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return a.key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	//exp is optional in jwt, but join tokens must expire
+	if claims.ExpiresAt == 0 {
+		return nil, errors.New("token has no exp")
+	}
+
+	if claims.SessionId == "" || claims.TokenId == "" {
+		return nil, errTokenForbidden
+	}
+
+	return claims, nil
+}
+
+func (a *Authenticator) canIssue() bool {
+	return a.signingKey != nil
+}
+
+func (a *Authenticator) issue(claims *joinClaims) (string, error) {
+	if !a.canIssue() {
+		return "", errors.New("no signing key")
+	}
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(a.algorithm), claims)
+	return token.SignedString(a.signingKey)
+}
+
+// tokenFromRequest reads the token from the `token` query or a Bearer header,
+// browsers can't set headers on WebSocket so the query is the usual way
+func tokenFromRequest(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if strings.HasPrefix(authorization, "Bearer ") {
+		return strings.TrimPrefix(authorization, "Bearer ")
+	}
+	return ""
+}
@@ -0,0 +1,108 @@
+package libs
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const testSecret = "test-secret"
+
+func testClaims(change func(c *joinClaims)) *joinClaims {
+	claims := &joinClaims{
+		SessionId: "session",
+		TokenId:   "token",
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+	}
+	if change != nil {
+		change(claims)
+	}
+	return claims
+}
+
+func signHS256(t *testing.T, key []byte, claims *joinClaims) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestAuthenticatorVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+
+	hs256 := &Authenticator{algorithm: "HS256", key: []byte(testSecret)}
+	rs256 := &Authenticator{algorithm: "RS256", key: &rsaKey.PublicKey}
+
+	rsSigned, err := jwt.NewWithClaims(jwt.SigningMethodRS256, testClaims(nil)).SignedString(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, testClaims(nil)).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		auth  *Authenticator
+		token string
+		ok    bool
+	}{
+		{"valid hs256", hs256, signHS256(t, []byte(testSecret), testClaims(nil)), true},
+		{"valid rs256", rs256, rsSigned, true},
+		{"missing token", hs256, "", false},
+		{"wrong secret", hs256, signHS256(t, []byte("other"), testClaims(nil)), false},
+		{"alg none", hs256, unsigned, false},
+		//hs256 signed with the public key, accepted by verifiers that trust the alg header
+		{"alg confusion", rs256, signHS256(t, publicPEM, testClaims(nil)), false},
+		{"rs256 token on hs256", hs256, rsSigned, false},
+		{"expired", hs256, signHS256(t, []byte(testSecret), testClaims(func(c *joinClaims) {
+			c.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+		})), false},
+		{"not yet valid", hs256, signHS256(t, []byte(testSecret), testClaims(func(c *joinClaims) {
+			c.NotBefore = time.Now().Add(time.Hour).Unix()
+		})), false},
+		{"no exp", hs256, signHS256(t, []byte(testSecret), testClaims(func(c *joinClaims) {
+			c.ExpiresAt = 0
+		})), false},
+		{"no sessionId", hs256, signHS256(t, []byte(testSecret), testClaims(func(c *joinClaims) {
+			c.SessionId = ""
+		})), false},
+		{"no tokenId", hs256, signHS256(t, []byte(testSecret), testClaims(func(c *joinClaims) {
+			c.TokenId = ""
+		})), false},
+		{"garbage", hs256, "not.a.token", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := tt.auth.verify(tt.token)
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("verify failed : %v", err)
+				}
+				if claims.SessionId != "session" || claims.TokenId != "token" {
+					t.Fatalf("unexpected claims %+v", claims)
+				}
+			} else if err == nil {
+				t.Fatal("verify accepted the token")
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package libs
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// inflightRequest is a client request that can still be cancelled
+type inflightRequest struct {
+	cancel context.CancelFunc
+}
+
+// queuedRequest is a request waiting in recv with its context, it can be cancelled while queued
+type queuedRequest struct {
+	msg  *clientMessage
+	ctx  context.Context
+	done context.CancelFunc
+}
+
+// requestContext ends when the client cancels the request or its deadline passes,
+// the returned func has to be called once the request is answered
+func (c *client) requestContext(msg *clientMessage) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if msg.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(msg.Timeout)*time.Millisecond)
+	}
+	//requests without id can't be referenced by a cancel
+	if msg.Id == nil {
+		return ctx, cancel
+	}
+
+	key := string(msg.Id)
+	inflight := &inflightRequest{cancel: cancel}
+	c.inflightMu.Lock()
+	c.inflight[key] = inflight
+	c.inflightMu.Unlock()
+
+	return ctx, func() {
+		c.inflightMu.Lock()
+		if c.inflight[key] == inflight {
+			delete(c.inflight, key)
+		}
+		c.inflightMu.Unlock()
+		cancel()
+	}
+}
+
+// cancelRequest cancels a request of the client, it reports whether the request was still running
+func (c *client) cancelRequest(id json.RawMessage) bool {
+	c.inflightMu.Lock()
+	inflight, ok := c.inflight[string(id)]
+	c.inflightMu.Unlock()
+	if ok {
+		inflight.cancel()
+	}
+	return ok
+}
+
+// contextError is the error of a request whose context ended
+func contextError(ctx context.Context) *signalError {
+	switch ctx.Err() {
+	case context.Canceled:
+		return newSignalError(codeCancelled, "cancelled")
+	case context.DeadlineExceeded:
+		return newSignalError(codeMediaTimeout, "deadline exceeded")
+	}
+	return nil
+}
+
+// handleCancel answers a cancel right away, the cancelled request answers with a cancelled error
+func (c *client) handleCancel(msg *clientMessage) {
+	req, err := decodeRequest(msg.Event, msg.Data)
+	if err != nil {
+		c.responseError(msg.Id, err)
+		return
+	}
+	if !c.cancelRequest(req.(*cancelRequest).Id) {
+		Log.Debugf("%s cancelled a finished request\n", c.tokenId)
+	}
+	c.responseClientWithoutData(msg.Id)
+}
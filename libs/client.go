@@ -1,6 +1,8 @@
 package libs
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/google/uuid"
@@ -8,6 +10,7 @@ import (
 	"github.com/nats-io/nats.go"
 	"math/rand"
 	"reflect"
+	"sync"
 	"time"
 )
 
@@ -16,6 +19,10 @@ const (
 	pongWait       = 60 * time.Second
 	pingPeriod     = (pongWait * 9) / 10
 	maxMessageSize = 10240 //TODO: adjust
+	//media requests give up after this, a client deadline may end them sooner
+	mediaRequestTimeout = 10 * time.Second
+	//requests read but not yet dispatched, more are answered with 429
+	maxPendingRequests = 64
 )
 
 type jsonMap = map[string]interface{}
@@ -24,18 +31,42 @@ type client struct {
 	clientGroup *ClientGroup
 	tokenId     string
 	sessionId   string
+	//distinguishes connections of the same tokenId
+	connectionId string
+	//mu guards fields changed by handlers and read by NATS callbacks
+	mu          sync.RWMutex
 	metadata    map[string]string
-	isPub       bool
-	isSub       bool
-	pubTransId  string
-	subTransId  string
-	conn        *websocket.Conn
-	send        chan interface{}
-	recv        chan []byte
-	selfSub     *nats.Subscription
-	sessionSub  *nats.Subscription
+	permissions *Permissions
+	handshake   handshake
+	//set once a newer connection of the tokenId took over
+	replaced bool
+	//kept to check session access again on join
+	password   string
+	limiter    *clientLimiter
+	isPub      bool
+	isSub      bool
+	pubTransId string
+	subTransId string
+	conn       *websocket.Conn
+	protocol   protocol
+	codec      codec
+	send       chan interface{}
+	//closed when writePump exits, nothing is sent after that
+	done       chan struct{}
+	recv       chan *queuedRequest
+	selfSub    *nats.Subscription
+	sessionSub *nats.Subscription
+	connSub    *nats.Subscription
 	//FIXME: maybe pub,sub use different mediaserver
 	mediaServer *MediaServer
+	dispatcher  *dispatcher
+	//server requests waiting for their response, by raw json id
+	pendingMu     sync.Mutex
+	pending       map[string]chan clientResponse
+	lastRequestId int64
+	//client requests that can be cancelled, by raw json id
+	inflightMu sync.Mutex
+	inflight   map[string]*inflightRequest
 }
 
 type requestParams struct {
@@ -58,33 +89,42 @@ type requestParams struct {
 //	}
 //}
 
-func (c *client) responseClient(id int, params interface{}) {
-	response := jsonMap{
-		"method": "response",
-		"id":     id,
-		"params": params,
+func (c *client) hasCapability(name string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.handshake.capabilities[name]
+}
+
+// write queues a message for writePump, it's dropped once the connection is gone
+func (c *client) write(v interface{}) {
+	if v == nil {
+		return
+	}
+	select {
+	case c.send <- v:
+	case <-c.done:
 	}
-	c.send <- response
-	//c.sendJson(response)
+}
+
+func (c *client) responseClient(id json.RawMessage, params interface{}) {
+	c.write(c.protocol.response(id, params))
 }
 
 func (c *client) notification(event string, data interface{}) {
-	response := jsonMap{
-		"method": "notification",
-		"params": jsonMap{
-			"event": event,
-			"data":  data,
-		},
-	}
-	//c.sendJson(response)
-	c.send <- response
+	c.write(c.protocol.notification(event, data))
+}
+
+func (c *client) responseError(id json.RawMessage, err *signalError) {
+	c.write(c.protocol.errorResponse(id, err))
 }
 
-func (c *client) responseClientWithoutData(id int) {
-	c.responseClient(id, map[string]string{})
+func (c *client) responseClientWithoutData(id json.RawMessage) {
+	c.responseClient(id, emptyResponse{})
 }
 
-func (c *client) selectMediaServer(mediaId string) {
+func (c *client) selectMediaServer(mediaId string) *signalError {
+	c.clientGroup.mediaMu.Lock()
+	defer c.clientGroup.mediaMu.Unlock()
 
 	selectedMedia := mediaId
 	if len(c.clientGroup.mediaServers) > 0 {
@@ -101,166 +141,472 @@ func (c *client) selectMediaServer(mediaId string) {
 				c.mediaServer = ms
 			}
 		}
-	} else {
-		//TODO(CC): no media server
+	} else if c.mediaServer == nil {
+		return newSignalError(codeNoMediaServer, "no media server")
 	}
+	return nil
 }
 
-func (c *client) handleClientMessage(message []byte) {
-	var requestMes *requestMessage
-	jsonErr := json.Unmarshal(message, &requestMes)
-	if jsonErr != nil {
-		//TODO(CC):
-		Log.Errorf("Client message json parse error : %v", jsonErr)
+// broadcasts reports whether the request ends in a publish2Session
+func broadcasts(req request) bool {
+	switch r := req.(type) {
+	case *joinRequest, *publishRequest, *unpublishRequest, *updateMetadataRequest, *setAttributesRequest:
+		return true
+	case *messageRequest:
+		return r.To == ""
+	case *pauseRequest:
+		return r.Role == "pub"
+	}
+	return false
+}
+
+// readMessage decodes a message, responses are resolved here so a waiting request never blocks processPump
+func (c *client) readMessage(message []byte) {
+	requestMes, err := c.protocol.decode(message)
+	if err != nil {
+		Log.Errorf("Client message decode error : %v", err)
+		//the id is unknown if the message is no json
+		var id json.RawMessage
+		if requestMes != nil {
+			id = requestMes.Id
+		}
+		c.responseError(id, err)
+		return
+	}
+
+	//every message counts, cancels and responses included
+	event := requestMes.Event
+	if requestMes.Response {
+		event = "response"
+	}
+	if !c.limiter.allow(event) {
+		Log.Warnf("%s %s rate limited\n", c.tokenId, event)
+		//responses are dropped without an answer
+		if !requestMes.Response {
+			c.responseError(requestMes.Id, newSignalError(codeTooManyRequests, "rate limited"))
+		}
+		if c.limiter.exceeded() {
+			Log.Warnf("%s exceeded rate limit too often, disconnect\n", c.tokenId)
+			c.disconnect(websocket.ClosePolicyViolation, "rate limited")
+		}
 		return
 	}
 
+	if requestMes.Response {
+		c.resolveRequest(requestMes)
+		return
+	}
+	//a cancel must not wait behind the request it cancels
+	if requestMes.Event == "cancel" {
+		c.handleCancel(requestMes)
+		return
+	}
+	//registered before queueing, a cancel reaches requests still waiting in recv
+	ctx, done := c.requestContext(requestMes)
+	//readPump never waits for processPump, a cancel behind a busy dispatcher is still read
+	select {
+	case c.recv <- &queuedRequest{msg: requestMes, ctx: ctx, done: done}:
+	default:
+		done()
+		Log.Warnf("%s has too many pending requests\n", c.tokenId)
+		c.responseError(requestMes.Id, newSignalError(codeTooManyRequests, "too many pending requests"))
+	}
+}
+
+func (c *client) handleClientMessage(queued *queuedRequest) {
+	requestMes, ctx, done := queued.msg, queued.ctx, queued.done
 	//fmt.Println(len(message))
 	Log.Tracef("message : %v", requestMes)
-	if requestMes.Method == "request" {
-		data := requestMes.Params.Data
-		switch requestMes.Params.Event {
-		case "join":
-			pub := requestMes.Params.Data["pub"].(bool)
-			sub := requestMes.Params.Data["sub"].(bool)
 
-			if mediaIdAny, ok := requestMes.Params.Data["mediaId"]; ok {
-				mediaId := fmt.Sprintf("%v", mediaIdAny)
-				c.selectMediaServer(mediaId)
-			} else {
-				c.selectMediaServer("")
-			}
+	event := requestMes.Event
 
-			codecData := c.requestMediaNoParams("codecs")
+	//cancelled while queued
+	err := contextError(ctx)
+	var req request
+	if err == nil {
+		req, err = c.checkRequest(requestMes)
+	}
+	if err != nil {
+		done()
+		c.responseError(requestMes.Id, err)
+		return
+	}
 
-			responseParams := jsonMap{
-				"codecs": codecData["codecs"],
-			}
+	c.dispatcher.dispatch(orderKey(req), func() {
+		defer done()
+		//cancelled while waiting for its turn
+		err := contextError(ctx)
+		if err == nil && requestMes.IdempotencyKey != "" {
+			err = c.handleIdempotent(ctx, requestMes, req)
+		} else if err == nil {
+			err = c.handleRequest(ctx, requestMes.Id, event, req)
+		}
+		if err != nil {
+			Log.Warnf("%s request %s failed : %v\n", c.tokenId, event, err)
+			c.responseError(requestMes.Id, err)
+		}
+	})
+}
 
-			if pub {
-				c.isPub = true
+// checkRequest decodes a request and checks whether the client may send it now
+func (c *client) checkRequest(requestMes *clientMessage) (request, *signalError) {
+	event := requestMes.Event
 
-				transportId, _ := uuid.NewUUID()
-				c.pubTransId = transportId.String()
+	if validator := c.clientGroup.requestValidator; validator != nil {
+		if err := validator.validate(event, requestMes.Data); err != nil {
+			return nil, err
+		}
+	}
 
-				mediaRequest := jsonMap{
-					"transportId": c.pubTransId,
-					"role":        "pub",
-				}
-				pubData := c.requestMedia("transport", mediaRequest)
-				responseParams["pub"] = pubData["transportParameters"]
-			}
+	req, err := decodeRequest(event, requestMes.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.permissions.allow(req) {
+		Log.Warnf("%s is not allowed to %s\n", c.tokenId, event)
+		return nil, newSignalError(codeForbidden, "permission denied")
+	}
+
+	if requestMes.IdempotencyKey != "" && !idempotent(req) {
+		return nil, errInvalidParams("idempotency keys are only allowed on publish and subscribe")
+	}
 
-			if sub {
-				c.isSub = true
+	if broadcasts(req) && !c.clientGroup.limiter.allowBroadcast(c.sessionId) {
+		Log.Warnf("Session %s broadcast rate limited\n", c.sessionId)
+		return nil, newSignalError(codeTooManyRequests, "session rate limited")
+	}
+	return req, nil
+}
+
+// handleRequest answers a request itself on success, errors are answered by the caller
+func (c *client) handleRequest(ctx context.Context, id json.RawMessage, event string, req request) *signalError {
+	switch req := req.(type) {
+	case *helloRequest:
+		h, err := negotiate(req.Version, req.Capabilities)
+		if err != nil {
+			return err
+		}
+		//NATS callbacks read the capabilities
+		c.mu.Lock()
+		c.handshake = h
+		c.mu.Unlock()
+		c.respond(ctx, id, h.response())
+
+	case *joinRequest:
+		if !c.clientGroup.sessions.admit(c.sessionId, c.tokenId, c.password) {
+			return newSignalError(codeUnauthorized, "not admitted to session")
+		}
+
+		if err := c.selectMediaServer(req.MediaId); err != nil {
+			return err
+		}
+
+		codecData, err := c.requestMediaNoParams(ctx, "codecs")
+		if err != nil {
+			return err
+		}
+
+		response := joinResponse{
+			Codecs: codecData["codecs"],
+		}
+
+		var pubTransId, subTransId string
+		if req.Pub {
+			transportId, _ := uuid.NewUUID()
+			pubTransId = transportId.String()
+
+			mediaRequest := jsonMap{
+				"transportId": pubTransId,
+				"role":        "pub",
+			}
+			pubData, err := c.requestMedia(ctx, "transport", mediaRequest)
+			if err != nil {
+				return err
+			}
+			response.Pub = pubData["transportParameters"]
+		}
 
-				transportId, _ := uuid.NewUUID()
-				c.subTransId = transportId.String()
+		if req.Sub {
+			transportId, _ := uuid.NewUUID()
+			subTransId = transportId.String()
 
-				mediaRequest := jsonMap{
-					"transportId": c.subTransId,
-					"role":        "sub",
+			mediaRequest := jsonMap{
+				"transportId": subTransId,
+				"role":        "sub",
+			}
+			pubData, err := c.requestMedia(ctx, "transport", mediaRequest)
+			if err != nil {
+				//a failed join leaves nothing behind, a retry starts over
+				if pubTransId != "" {
+					c.closeTransport(pubTransId, "pub")
 				}
-				pubData := c.requestMedia("transport", mediaRequest)
-				responseParams["sub"] = pubData["transportParameters"]
+				return err
 			}
+			response.Sub = pubData["transportParameters"]
+		}
 
-			c.responseClient(requestMes.Id, responseParams)
+		//committed only once every transport exists
+		c.mu.Lock()
+		c.isPub = req.Pub
+		c.pubTransId = pubTransId
+		c.isSub = req.Sub
+		c.subTransId = subTransId
+		c.mu.Unlock()
 
-			c.publish2Session("join", jsonMap{
-				"metadata": c.metadata,
-				"pub":      c.isPub,
-				"sub":      c.isSub,
-			})
+		c.clientGroup.sessions.joined(c)
 
+		roster := c.hasCapability(capRoster)
+		if roster {
+			//subscribed before the snapshot so no change is missed, notifications may repeat it
 			c.subscribeNATS()
+			response.Roster = c.clientGroup.sessions.roster(c.sessionId, c.connectionId)
+			attributes, version := c.clientGroup.sessions.attributes(c.sessionId)
+			response.Attributes = &attributesResponse{Attributes: attributes, Version: version}
+		}
 
-		case "dtls":
-			c.requestMedia("dtls", jsonMap{
-				"transportId":    requestMes.Params.Data["transportId"],
-				"dtlsParameters": requestMes.Params.Data["dtlsParameters"],
-			})
-			c.responseClientWithoutData(requestMes.Id)
-		case "publish":
-			senderData := c.requestMedia("publish", jsonMap{
-				"transportId": requestMes.Params.Data["transportId"],
-				"codec":       requestMes.Params.Data["codec"],
-				"metadata":    requestMes.Params.Data["metadata"],
-			})
-			c.responseClient(requestMes.Id, jsonMap{
-				"senderId": senderData["senderId"],
-			})
+		c.respond(ctx, id, response)
 
-			c.publish2Session("publish", jsonMap{
-				"mediaId":     c.mediaServer.Id,
-				"area":        c.mediaServer.Area,
-				"host":        c.mediaServer.Host,
-				"transportId": c.pubTransId,
-				"senderId":    senderData["senderId"],
-				"metadata":    requestMes.Params.Data["metadata"],
-			})
-		case "unpublish":
-			c.requestMedia("unpublish", jsonMap{
-				"transportId": data["transportId"],
-				"senderId":    data["senderId"],
-			})
-			c.responseClientWithoutData(requestMes.Id)
+		c.publish2Session("join", &joinNotice{
+			Metadata: c.currentMetadata(),
+			Pub:      c.isPub,
+			Sub:      c.isSub,
+			Roster:   roster,
+		})
 
-			c.publish2Session("unpublish", jsonMap{
-				"senderId": data["senderId"],
-			})
-		case "subscribe":
+		if !roster {
+			c.subscribeNATS()
+		}
 
-			subData := c.requestMedia("subscribe", jsonMap{
-				"mediaId":           data["mediaId"],
-				"remoteTransportId": data["transportId"],
-				"transportId":       c.subTransId,
-				"senderId":          data["senderId"],
-			})
+	case *setAccessRequest:
+		err := c.clientGroup.sessions.setAccess(c.sessionId, req.Password, req.Invites)
+		if err != nil {
+			Log.Errorf("Session %s access error : %v\n", c.sessionId, err)
+			return newSignalError(codeInternalError, "set access failed")
+		}
+		Log.Infof("Session %s access changed by %s\n", c.sessionId, c.tokenId)
+		c.respond(ctx, id, emptyResponse{})
+	case *dtlsRequest:
+		_, err := c.requestMedia(ctx, "dtls", jsonMap{
+			"transportId":    req.TransportId,
+			"dtlsParameters": req.DtlsParameters,
+		})
+		if err != nil {
+			return err
+		}
+		c.respond(ctx, id, emptyResponse{})
+	case *publishRequest:
+		if err := c.clientGroup.metadata.validateSender(req.Metadata); err != nil {
+			return newSignalError(codeBadRequest, "%v", err)
+		}
 
-			c.responseClient(requestMes.Id, jsonMap{
-				"codec":      subData["codec"],
-				"receiverId": subData["receiverId"],
-				"senderId":   data["senderId"],
-			})
-		case "unsubscribe":
-			c.requestMedia("unsubscribe", jsonMap{
-				"transportId": data["transportId"],
-				"senderId":    data["senderId"],
-			})
-			c.responseClientWithoutData(requestMes.Id)
-		case "pause":
-			c.requestMedia("pause", jsonMap{
-				"transportId": data["transportId"],
-				"senderId":    data["senderId"],
-				"role":        data["role"],
-			})
-			c.responseClientWithoutData(requestMes.Id)
-			if data["role"].(string) == "pub" {
-				c.publish2Session("pause", jsonMap{
-					"senderId": data["senderId"],
-				})
-			}
-		case "resume":
-			c.requestMedia("resume", jsonMap{
-				"transportId": data["transportId"],
-				"senderId":    data["senderId"],
-				"role":        data["role"],
+		senderData, err := c.requestMedia(ctx, "publish", jsonMap{
+			"transportId": req.TransportId,
+			"codec":       req.Codec,
+			"metadata":    req.Metadata,
+		})
+		if err != nil {
+			return err
+		}
+		senderId, ok := senderData["senderId"].(string)
+		if !ok {
+			return newSignalError(codeMediaError, "invalid media response")
+		}
+		c.respond(ctx, id, publishResponse{
+			SenderId: senderId,
+		})
+
+		c.clientGroup.sessions.addSender(c, &publishNotification{
+			MediaId:     c.mediaServer.Id,
+			Area:        c.mediaServer.Area,
+			Host:        c.mediaServer.Host,
+			TransportId: c.pubTransId,
+			SenderId:    senderId,
+			Metadata:    req.Metadata,
+			TokenId:     c.tokenId,
+		})
+
+		c.publish2Session("publish", &publishNotice{
+			MediaId:     c.mediaServer.Id,
+			Area:        c.mediaServer.Area,
+			Host:        c.mediaServer.Host,
+			TransportId: c.pubTransId,
+			SenderId:    senderId,
+			Metadata:    req.Metadata,
+		})
+	case *unpublishRequest:
+		_, err := c.requestMedia(ctx, "unpublish", jsonMap{
+			"transportId": req.TransportId,
+			"senderId":    req.SenderId,
+		})
+		if err != nil {
+			return err
+		}
+		c.respond(ctx, id, emptyResponse{})
+
+		c.clientGroup.sessions.removeSender(c, req.SenderId)
+
+		c.publish2Session("unpublish", &senderNotice{
+			SenderId: req.SenderId,
+		})
+	case *subscribeRequest:
+
+		subData, err := c.requestMedia(ctx, "subscribe", jsonMap{
+			"mediaId":           req.MediaId,
+			"remoteTransportId": req.TransportId,
+			"transportId":       c.subTransId,
+			"senderId":          req.SenderId,
+		})
+		if err != nil {
+			return err
+		}
+
+		c.respond(ctx, id, subscribeResponse{
+			Codec:      subData["codec"],
+			ReceiverId: subData["receiverId"],
+			SenderId:   req.SenderId,
+		})
+	case *unsubscribeRequest:
+		_, err := c.requestMedia(ctx, "unsubscribe", jsonMap{
+			"transportId": req.TransportId,
+			"senderId":    req.SenderId,
+		})
+		if err != nil {
+			return err
+		}
+		c.respond(ctx, id, emptyResponse{})
+	case *pauseRequest:
+		//pause or resume
+		_, err := c.requestMedia(ctx, event, jsonMap{
+			"transportId": req.TransportId,
+			"senderId":    req.SenderId,
+			"role":        req.Role,
+		})
+		if err != nil {
+			return err
+		}
+		c.respond(ctx, id, emptyResponse{})
+		if req.Role == "pub" {
+			c.publish2Session(event, &senderNotice{
+				SenderId: req.SenderId,
 			})
-			c.responseClientWithoutData(requestMes.Id)
-			if data["role"].(string) == "pub" {
-				c.publish2Session("resume", jsonMap{
-					"senderId": data["senderId"],
-				})
-			}
 		}
+	case *messageRequest:
+		if max := c.clientGroup.maxMessageData; max > 0 && len(req.Data) > max {
+			return newSignalError(codePayloadTooLarge, "message data exceeds %d bytes", max)
+		}
+		if req.To == "" {
+			c.publish2Session("message", &dataNotice{Data: req.Data})
+		} else if len(c.clientGroup.sessions.connections(c.sessionId, req.To)) == 0 {
+			return newSignalError(codeNotFound, "%s is not in the session", req.To)
+		} else {
+			c.publish2One(req.To, "message", &dataNotice{Data: req.Data})
+		}
+		c.respond(ctx, id, emptyResponse{})
+	case *updateMetadataRequest:
+		if err := c.updateMetadata(req); err != nil {
+			return err
+		}
+		c.respond(ctx, id, emptyResponse{})
+	case *setAttributesRequest:
+		attributes, err := c.clientGroup.sessions.setAttributes(c.sessionId, req.Attributes, req.Version)
+		if err != nil {
+			return err
+		}
+		c.respond(ctx, id, attributesResponse{Attributes: attributes.Values, Version: attributes.Version})
+		c.publish2Session("attributesChanged", &attributesNotice{Attributes: req.Attributes, Version: attributes.Version})
+	case *getAttributesRequest:
+		attributes, version := c.clientGroup.sessions.attributes(c.sessionId)
+		c.respond(ctx, id, attributesResponse{Attributes: attributes, Version: version})
+	case *kickRequest:
+		if err := c.kick(req); err != nil {
+			return err
+		}
+		c.respond(ctx, id, emptyResponse{})
+	case *muteRemoteRequest:
+		if err := c.muteRemote(req); err != nil {
+			return err
+		}
+		c.respond(ctx, id, emptyResponse{})
+	case *endSessionRequest:
+		if err := c.endSession(); err != nil {
+			return err
+		}
+		//answered first, the moderator is disconnected too
+		c.respond(ctx, id, emptyResponse{})
+		c.notification("sessionEnded", sessionEndedNotification{
+			TokenId: c.tokenId,
+		})
+		c.disconnect(websocket.CloseNormalClosure, "session ended")
+	}
+	return nil
+}
+
+// updateMetadata changes the metadata of the participant or of its sender and tells the session,
+// the media server keeps the sender metadata it got on publish
+func (c *client) updateMetadata(req *updateMetadataRequest) *signalError {
+	if req.SenderId != "" {
+		if c.clientGroup.sessions.sender(c, req.SenderId) == nil {
+			return newSignalError(codeNotFound, "unknown sender %s", req.SenderId)
+		}
+		var metadata interface{}
+		if err := json.Unmarshal(req.Metadata, &metadata); err != nil {
+			return errInvalidParams("invalid metadata : %v", err)
+		}
+		if err := c.clientGroup.metadata.validateSender(metadata); err != nil {
+			return newSignalError(codeBadRequest, "%v", err)
+		}
+		c.clientGroup.sessions.setSenderMetadata(c, req.SenderId, metadata)
+		c.publish2Session("metadataChanged", &metadataNotice{SenderId: req.SenderId, Metadata: metadata})
+		return nil
+	}
 
+	var metadata map[string]string
+	if err := json.Unmarshal(req.Metadata, &metadata); err != nil {
+		return errInvalidParams("invalid metadata : %v", err)
+	}
+	if err := c.clientGroup.metadata.validateParticipant(metadata); err != nil {
+		return newSignalError(codeBadRequest, "%v", err)
 	}
+	c.mu.Lock()
+	c.metadata = metadata
+	c.mu.Unlock()
+	c.clientGroup.sessions.setMetadata(c, metadata)
+	c.publish2Session("metadataChanged", &metadataNotice{Metadata: metadata})
+	return nil
+}
+
+// joinedAs reports the transports committed by join, their ids are set before
+func (c *client) joinedAs() (isPub bool, isSub bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.isPub, c.isSub
+}
+
+// closeTransport releases a transport on the media server
+func (c *client) closeTransport(transportId string, role string) {
+	c.clientGroup.idempotency.dropTransport(transportId)
+	_, err := c.requestMedia(context.Background(), "close", jsonMap{
+		"transportId": transportId,
+		"role":        role,
+	})
+	if err != nil {
+		Log.Warnf("Close of transport %s failed : %v\n", transportId, err)
+	}
+}
+
+// currentMetadata is replaced as a whole on update, the returned map is never changed
+func (c *client) currentMetadata() map[string]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.metadata
 }
 
 type MediaRequest struct {
 	Method string  `json:"method"`
 	Params jsonMap `json:"params"`
+	//echoed in the signed response payload when media auth is enabled
+	Nonce string `json:"nonce,omitempty"`
 }
 
 type mediaResponse struct {
@@ -270,65 +616,87 @@ type mediaResponse struct {
 
 //NATS
 //---------------------
-func (c *client) publish2Session(method string, data jsonMap) {
+func (c *client) publish2Session(method string, data notice) {
 	sessionSubject := fmt.Sprintf("signal.%s.@", c.sessionId)
 
 	c.clientGroup.nc.Publish(sessionSubject, jsonMap{
-		"tokenId": c.tokenId,
-		"method":  method,
-		"data":    data,
+		"tokenId":      c.tokenId,
+		"connectionId": c.connectionId,
+		"method":       method,
+		"data":         data,
 	})
 }
 
-func (c *client) publish2One(tokenId string, method string, data jsonMap) {
+func (c *client) publish2One(tokenId string, method string, data notice) {
 	oneSubject := fmt.Sprintf("signal.%s.%s", c.sessionId, tokenId)
 
 	c.clientGroup.nc.Publish(oneSubject, jsonMap{
-		"tokenId": c.tokenId,
-		"method":  method,
-		"data":    data,
+		"tokenId":      c.tokenId,
+		"connectionId": c.connectionId,
+		"method":       method,
+		"data":         data,
+	})
+}
+
+// publish2Connection reaches a single connection wherever it's served
+func (c *client) publish2Connection(connectionId string, method string, data notice) {
+	connSubject := fmt.Sprintf("conn.%s", connectionId)
+
+	c.clientGroup.nc.Publish(connSubject, jsonMap{
+		"tokenId":      c.tokenId,
+		"connectionId": c.connectionId,
+		"method":       method,
+		"data":         data,
 	})
 }
 
 type natsSubscribedMessage struct {
-	TokenId string  `json:"tokenId"`
-	Method  string  `json:"method"`
-	Data    jsonMap `json:"data"`
+	TokenId      string          `json:"tokenId"`
+	ConnectionId string          `json:"connectionId"`
+	Method       string          `json:"method"`
+	Data         json.RawMessage `json:"data"`
 }
 
-func (c *client) notifySenders(tokenId string) {
+// fromSelf reports whether a NATS message comes from this client, other
+// connections of the same tokenId are peers only when multiple are allowed
+func (c *client) fromSelf(msg *natsSubscribedMessage) bool {
+	if c.clientGroup.duplicatePolicy == DuplicateMulti {
+		return msg.ConnectionId == c.connectionId
+	}
+	return msg.TokenId == c.tokenId
+}
 
-	sendersData := c.requestMedia("senders", jsonMap{
-		"transportId": c.pubTransId,
-	})
-	senders := sendersData["senders"].([]interface{})
-
-	for _, s := range senders {
-		sender := s.(jsonMap)
-		c.publish2One(tokenId, "publish", jsonMap{
-			"mediaId":     c.mediaServer.Id,
-			"area":        c.mediaServer.Area,
-			"host":        c.mediaServer.Host,
-			"transportId": c.pubTransId,
-			"senderId":    sender["id"],
-			"metadata":    sender["metadata"],
+// notifySenders tells tokenId about the senders of c, the session store has their current metadata
+func (c *client) notifySenders(tokenId string) {
+	for _, sender := range c.clientGroup.sessions.senders(c) {
+		c.publish2One(tokenId, "publish", &publishNotice{
+			MediaId:     sender.MediaId,
+			Area:        sender.Area,
+			Host:        sender.Host,
+			TransportId: sender.TransportId,
+			SenderId:    sender.SenderId,
+			Metadata:    sender.Metadata,
 		})
 	}
 }
 
 func (c *client) notifySender2Client(tokenId string, senderId string, metadata interface{}) {
 
-	subData := c.requestMedia("subscribe", jsonMap{
+	subData, err := c.requestMedia(context.Background(), "subscribe", jsonMap{
 		"transportId": c.subTransId,
 		"senderId":    senderId,
 	})
+	if err != nil {
+		Log.Warnf("Subscribe for %s : %v\n", c.tokenId, err)
+		return
+	}
 
-	c.notification("publish", jsonMap{
-		"codec":      subData["codec"],
-		"receiverId": subData["receiverId"],
-		"senderId":   senderId,
-		"tokenId":    tokenId,
-		"metadata":   metadata,
+	c.notification("publish", subscribedNotification{
+		Codec:      subData["codec"],
+		ReceiverId: subData["receiverId"],
+		SenderId:   senderId,
+		TokenId:    tokenId,
+		Metadata:   metadata,
 	})
 
 }
@@ -342,36 +710,43 @@ func (c *client) subscribeNATS() {
 		var msg natsSubscribedMessage
 		err := json.Unmarshal(m.Data, &msg)
 		if err != nil {
-			Log.Warnf("Self NATS json decode error : %w\n", err)
+			Log.Warnf("Self NATS json decode error : %v\n", err)
+			return
+		}
+		if c.fromSelf(&msg) {
+			return
+		}
+		data, err := decodeNotice(&msg)
+		if err != nil {
+			Log.Warnf("Self NATS %s invalid : %v\n", msg.Method, err)
+			return
 		}
 
 		tokenId := msg.TokenId
 		switch msg.Method {
 		case "join":
-			metadata := msg.Data["metadata"]
-			sub := msg.Data["sub"].(bool)
+			join := data.(*joinNotice)
 
-			c.notification("join", jsonMap{
-				"tokenId":  tokenId,
-				"metadata": metadata,
+			c.notification("join", joinNotification{
+				TokenId:      tokenId,
+				ConnectionId: msg.ConnectionId,
+				Metadata:     join.Metadata,
 			})
 
 			//FIXME: maybe useless
-			if c.isPub && sub {
+			if isPub, _ := c.joinedAs(); isPub && join.Sub {
 				c.notifySenders(tokenId)
 			}
 		case "publish":
-			c.notification("publish", jsonMap{
-				"mediaId":     msg.Data["mediaId"],
-				"area":        msg.Data["area"],
-				"host":        msg.Data["host"],
-				"transportId": msg.Data["transportId"],
-				"senderId":    msg.Data["senderId"],
-				"metadata":    msg.Data["metadata"],
-				"tokenId":     tokenId,
-			})
+			c.notifyPublish(tokenId, data.(*publishNotice))
 			//c.notifySender2Client(tokenId, senderId, metadata)
-
+		case "message":
+			c.notification("message", messageNotification{
+				TokenId:      tokenId,
+				ConnectionId: msg.ConnectionId,
+				Data:         rawJSON(data.(*dataNotice).Data),
+				Direct:       true,
+			})
 		}
 
 	})
@@ -385,82 +760,266 @@ func (c *client) subscribeNATS() {
 		var msg natsSubscribedMessage
 		err := json.Unmarshal(m.Data, &msg)
 		if err != nil {
-			Log.Warnf("Session NATS json decode error : %w\n", err)
+			Log.Warnf("Session NATS json decode error : %v\n", err)
+			return
+		}
+		if c.fromSelf(&msg) {
+			return
+		}
+		data, err := decodeNotice(&msg)
+		if err != nil {
+			Log.Warnf("Session NATS %s invalid : %v\n", msg.Method, err)
+			return
 		}
 
 		tokenId := msg.TokenId
-		if tokenId != c.tokenId {
-			switch msg.Method {
-			case "join":
-				metadata := msg.Data["metadata"]
-				sub := msg.Data["sub"].(bool)
-
-				c.notification("join", jsonMap{
-					"tokenId":  tokenId,
-					"metadata": metadata,
-				})
+		switch msg.Method {
+		case "join":
+			join := data.(*joinNotice)
 
-				c.publish2One(tokenId, "join", jsonMap{
-					"metadata": c.metadata,
-					"pub":      c.isPub,
-					"sub":      c.isSub,
-				})
+			c.notification("join", joinNotification{
+				TokenId:      tokenId,
+				ConnectionId: msg.ConnectionId,
+				Metadata:     join.Metadata,
+			})
 
-				if c.isPub && sub {
-					c.notifySenders(tokenId)
-				}
+			if join.Roster {
+				break
+			}
 
-			case "leave":
-				c.notification("leave", jsonMap{
-					"tokenId": tokenId,
-				})
-			case "publish":
-				c.notification("publish", jsonMap{
-					"mediaId":     msg.Data["mediaId"],
-					"area":        msg.Data["area"],
-					"host":        msg.Data["host"],
-					"transportId": msg.Data["transportId"],
-					"senderId":    msg.Data["senderId"],
-					"metadata":    msg.Data["metadata"],
-					"tokenId":     tokenId,
-				})
-				//c.notifySender2Client(tokenId, senderId, metadata)
-			case "unpublish":
-				c.notification("unpublish", jsonMap{
-					"senderId": msg.Data["senderId"],
-					"tokenId":  tokenId,
-				})
-			case "pause":
-				c.notification("pause", jsonMap{
-					"senderId": msg.Data["senderId"],
-				})
-			case "resume":
-				c.notification("resume", jsonMap{
-					"senderId": msg.Data["senderId"],
-				})
+			isPub, isSub := c.joinedAs()
+			c.publish2One(tokenId, "join", &joinNotice{
+				Metadata: c.currentMetadata(),
+				Pub:      isPub,
+				Sub:      isSub,
+			})
+
+			if isPub && join.Sub {
+				c.notifySenders(tokenId)
 			}
+
+		case "leave":
+			c.notification("leave", leaveNotification{
+				TokenId:      tokenId,
+				ConnectionId: msg.ConnectionId,
+				Replaced:     data.(*leaveNotice).Replaced,
+			})
+		case "publish":
+			c.notifyPublish(tokenId, data.(*publishNotice))
+			//c.notifySender2Client(tokenId, senderId, metadata)
+		case "unpublish":
+			c.notification("unpublish", unpublishNotification{
+				SenderId: data.(*senderNotice).SenderId,
+				TokenId:  tokenId,
+			})
+		case "pause", "resume":
+			c.notification(msg.Method, pauseNotification{
+				SenderId: data.(*senderNotice).SenderId,
+			})
+		case "message":
+			c.notification("message", messageNotification{
+				TokenId:      tokenId,
+				ConnectionId: msg.ConnectionId,
+				Data:         rawJSON(data.(*dataNotice).Data),
+			})
+		case "attributesChanged":
+			changed := data.(*attributesNotice)
+			c.notification("attributesChanged", attributesChangedNotification{
+				TokenId:      tokenId,
+				ConnectionId: msg.ConnectionId,
+				Attributes:   changed.Attributes,
+				Version:      changed.Version,
+			})
+		case "metadataChanged":
+			changed := data.(*metadataNotice)
+			c.notification("metadataChanged", metadataChangedNotification{
+				TokenId:      tokenId,
+				ConnectionId: msg.ConnectionId,
+				SenderId:     changed.SenderId,
+				Metadata:     changed.Metadata,
+			})
 		}
 
 	})
 	c.sessionSub = sessionSub
 }
 
-func (c *client) requestMedia(method string, params jsonMap) jsonMap {
+func (c *client) notifyPublish(tokenId string, data *publishNotice) {
+	c.notification("publish", publishNotification{
+		MediaId:     data.MediaId,
+		Area:        data.Area,
+		Host:        data.Host,
+		TransportId: data.TransportId,
+		SenderId:    data.SenderId,
+		Metadata:    data.Metadata,
+		TokenId:     tokenId,
+	})
+}
+
+// subscribeConnection listens for messages addressed to this connection,
+// it's active from upgrade on, before the client joins
+func (c *client) subscribeConnection() {
+	connSubject := fmt.Sprintf("conn.%s", c.connectionId)
+	//TODO(CC): error
+	connSub, _ := c.clientGroup.nc.Subscribe(connSubject, func(m *nats.Msg) {
+		Log.Tracef("Connection NATS received a message: %s \n", string(m.Data))
+
+		var msg natsSubscribedMessage
+		err := json.Unmarshal(m.Data, &msg)
+		if err != nil {
+			Log.Warnf("Connection NATS json decode error : %v\n", err)
+			return
+		}
+
+		switch msg.Method {
+		case "replaced":
+			Log.Infof("%s connection %s replaced by %s\n", c.tokenId, c.connectionId, msg.ConnectionId)
+			c.mu.Lock()
+			c.replaced = true
+			c.mu.Unlock()
+			if c.hasCapability(capReplaced) {
+				c.notification("replaced", replacedNotification{
+					ConnectionId: msg.ConnectionId,
+				})
+			}
+			c.disconnect(websocket.CloseNormalClosure, "replaced")
+		case "kick", "mute", "endSession":
+			var signalErr *signalError
+			data, err := decodeNotice(&msg)
+			if err != nil {
+				Log.Warnf("Connection NATS %s invalid : %v\n", msg.Method, err)
+				signalErr = newSignalError(codeBadRequest, "invalid %s", msg.Method)
+			} else {
+				signalErr = c.handleModeration(&msg, data.(*moderationNotice))
+			}
+			//the moderator waits for the outcome
+			if m.Reply != "" {
+				c.clientGroup.nc.Publish(m.Reply, &moderationReply{Error: signalErr})
+			}
+		}
+	})
+	c.connSub = connSub
+}
+
+// createsMedia reports whether a media method creates state that has to be closed,
+// a cancel abandons the wait and the object is closed once its late reply arrives
+func createsMedia(method string) bool {
+	switch method {
+	case "transport", "publish", "subscribe":
+		return true
+	}
+	return false
+}
+
+// mediaResult is the outcome of a media request
+type mediaResult struct {
+	data jsonMap
+	err  *signalError
+}
 
-	request := MediaRequest{Method: method, Params: params}
+func (c *client) requestMedia(ctx context.Context, method string, params jsonMap) (jsonMap, *signalError) {
+	if c.mediaServer == nil {
+		return nil, newSignalError(codeNoMediaServer, "no media server")
+	}
+	if !createsMedia(method) {
+		return c.sendMedia(ctx, method, params)
+	}
+	if ctxErr := contextError(ctx); ctxErr != nil {
+		return nil, ctxErr
+	}
+
+	//the media server acts on it anyway, the request runs to its reply without ctx
+	results := make(chan mediaResult)
+	abandoned := make(chan struct{})
+	go func() {
+		data, err := c.sendMedia(context.Background(), method, params)
+		select {
+		case results <- mediaResult{data, err}:
+		case <-abandoned:
+			if err == nil {
+				c.closeOrphan(method, params, data)
+			}
+		}
+	}()
+
+	select {
+	case result := <-results:
+		return result.data, result.err
+	case <-ctx.Done():
+		close(abandoned)
+		Log.Debugf("Request %s abandoned : %v\n", method, ctx.Err())
+		return nil, contextError(ctx)
+	}
+}
+
+// closeOrphan closes what an abandoned request created, nobody was told about it
+func (c *client) closeOrphan(method string, params jsonMap, data jsonMap) {
+	switch method {
+	case "transport":
+		transportId, _ := params["transportId"].(string)
+		role, _ := params["role"].(string)
+		c.closeTransport(transportId, role)
+	case "publish":
+		_, err := c.sendMedia(context.Background(), "unpublish", jsonMap{
+			"transportId": params["transportId"],
+			"senderId":    data["senderId"],
+		})
+		if err != nil {
+			Log.Warnf("Unpublish of abandoned sender failed : %v\n", err)
+		}
+	case "subscribe":
+		_, err := c.sendMedia(context.Background(), "unsubscribe", jsonMap{
+			"transportId": params["transportId"],
+			"senderId":    params["senderId"],
+		})
+		if err != nil {
+			Log.Warnf("Unsubscribe of abandoned receiver failed : %v\n", err)
+		}
+	}
+}
+
+// sendMedia sends a request to the media server of the client and verifies the reply
+func (c *client) sendMedia(ctx context.Context, method string, params jsonMap) (jsonMap, *signalError) {
+	request := MediaRequest{Method: method, Params: params, Nonce: c.clientGroup.mediaAuth.nonce()}
 
 	var response mediaResponse
 
+	var rawResponse json.RawMessage
 	mediaSubject := fmt.Sprintf("media.%s", c.mediaServer.Id)
-	err := c.clientGroup.nc.Request(mediaSubject, request, &response, 10*time.Second)
-	if err != nil {
+	requestCtx, cancel := context.WithTimeout(ctx, mediaRequestTimeout)
+	defer cancel()
+	err := c.clientGroup.nc.RequestWithContext(requestCtx, mediaSubject, request, &rawResponse)
+	if ctxErr := contextError(ctx); ctxErr != nil {
+		Log.Debugf("Request %s abandoned : %v\n", method, ctxErr)
+		return nil, ctxErr
+	} else if err == nats.ErrTimeout || err == context.DeadlineExceeded {
+		Log.Warnf("Request timeout: %s\n", method)
+		return nil, newSignalError(codeMediaTimeout, "media server timeout")
+	} else if err != nil {
 		Log.Warnf("Request failed: %s %v\n", method, err)
+		return nil, newSignalError(codeMediaError, "media request failed")
 	}
 
+	payload, err := c.clientGroup.mediaAuth.open(c.mediaServer.Id, request.Nonce, rawResponse)
+	if err != nil {
+		Log.Warnf("Media %s response rejected : %v\n", c.mediaServer.Id, err)
+		return nil, newSignalError(codeMediaError, "media response rejected")
+	}
+	//integers like ports and payload types stay integers for binary codecs
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err = decoder.Decode(&response); err != nil {
+		Log.Warnf("Media response json decode error : %v\n", err)
+		return nil, newSignalError(codeMediaError, "invalid media response")
+	}
+	plainNumbers(response.Data)
+
 	if response.Method != "response" {
-		//TODO(CC): error
+		message, _ := response.Data["message"].(string)
+		Log.Warnf("Media %s %s error : %s\n", c.mediaServer.Id, method, message)
+		return nil, newSignalError(codeMediaError, "media error %s", message)
 	}
-	return response.Data
+	return response.Data, nil
 }
 
 //func (c *client) notifyMedia(method string, params jsonMap)  {
@@ -475,9 +1034,9 @@ func (c *client) requestMedia(method string, params jsonMap) jsonMap {
 //}
 //
 
-func (c *client) requestMediaNoParams(method string) jsonMap {
+func (c *client) requestMediaNoParams(ctx context.Context, method string) (jsonMap, *signalError) {
 	params := jsonMap{}
-	return c.requestMedia(method, params)
+	return c.requestMedia(ctx, method, params)
 }
 
 // WebSocket
@@ -493,42 +1052,68 @@ func (c *client) readPump() {
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 	for {
-		_, message, err := c.conn.ReadMessage()
+		messageType, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				Log.Warnf("Websocket error: %v", err)
 			} else {
 				Log.Debugf("Websocket closed, error : %v", err)
-
-				c.selfSub.Unsubscribe()
-				c.sessionSub.Unsubscribe()
-
-				c.publish2Session("leave", jsonMap{})
-
-				if c.isPub {
-					c.requestMedia("close", jsonMap{
-						"transportId": c.pubTransId,
-						"role":        "pub",
-					})
-				}
-
-				if c.isSub {
-					c.requestMedia("close", jsonMap{
-						"transportId": c.subTransId,
-						"role":        "sub",
-					})
-				}
 			}
+			c.cleanup()
 			break
 		}
-		c.recv <- message
+		//text frames are json even on binary connections
+		if messageType == websocket.BinaryMessage {
+			message, err = c.codec.toJSON(message)
+			if err != nil {
+				Log.Errorf("Client binary message decode error : %v", err)
+				c.responseError(nil, errParse())
+				continue
+			}
+		}
+		c.readMessage(message)
+	}
+}
+
+// cleanup releases everything of a closed connection
+func (c *client) cleanup() {
+	c.connSub.Unsubscribe()
+	c.selfSub.Unsubscribe()
+	c.sessionSub.Unsubscribe()
+
+	c.clientGroup.sessions.leave(c)
+	//peers keyed by tokenId keep the participant of a replaced connection
+	c.mu.RLock()
+	replaced := c.replaced
+	c.mu.RUnlock()
+	c.publish2Session("leave", &leaveNotice{Replaced: replaced})
+
+	isPub, isSub := c.joinedAs()
+	if isPub {
+		c.closeTransport(c.pubTransId, "pub")
+	}
+
+	if isSub {
+		c.closeTransport(c.subTransId, "sub")
 	}
 }
 
+// closeFrame asks writePump to close the connection after the messages queued before it
+type closeFrame struct {
+	code   int
+	reason string
+}
+
+// disconnect closes the connection, readPump then cleans up
+func (c *client) disconnect(code int, reason string) {
+	c.write(closeFrame{code: code, reason: reason})
+}
+
 func (c *client) writePump() {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
 		ticker.Stop()
+		close(c.done)
 		c.conn.Close()
 	}()
 	for {
@@ -540,9 +1125,18 @@ func (c *client) writePump() {
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
+			if frame, ok := jsonMsg.(closeFrame); ok {
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(frame.code, frame.reason))
+				return
+			}
 
-			if err := c.conn.WriteJSON(jsonMsg); err != nil {
-				Log.Warnf("Websocket json send error : %v", err)
+			data, err := c.codec.marshal(jsonMsg)
+			if err != nil {
+				Log.Errorf("Websocket message encode error : %v", err)
+				continue
+			}
+			if err := c.conn.WriteMessage(c.codec.messageType(), data); err != nil {
+				Log.Warnf("Websocket send error : %v", err)
 				//TODO:
 			}
 			//w, err := c.conn.NextWriter(websocket.TextMessage)
@@ -576,20 +1170,21 @@ func (c *client) processPump() {
 	}
 }
 
-type requestMessage struct {
-	Id     int    `json:"id"`
-	Method string `json:"method"`
-	Params struct {
-		Event string  `json:"event"`
-		Data  jsonMap `json:"data"`
-	} `json:"params"`
-}
-
-func newClient(clientGroup *ClientGroup, conn *websocket.Conn, tokenId string, sessionId string, metadata map[string]string) *client {
+func newClient(clientGroup *ClientGroup, conn *websocket.Conn, tokenId string, sessionId string, metadata map[string]string, permissions *Permissions) *client {
 	Log.Info("create client")
-	client := &client{clientGroup: clientGroup, tokenId: tokenId, sessionId: sessionId, metadata: metadata, isPub: false, isSub: false}
+	client := &client{clientGroup: clientGroup, tokenId: tokenId, sessionId: sessionId, metadata: metadata, permissions: permissions, isPub: false, isSub: false}
 	client.send = make(chan interface{})
-	client.recv = make(chan []byte)
+	client.done = make(chan struct{})
+	client.recv = make(chan *queuedRequest, maxPendingRequests)
+	client.pending = map[string]chan clientResponse{}
+	client.inflight = map[string]*inflightRequest{}
 	client.conn = conn
+	client.handshake = defaultHandshake()
+	protocolName, codecName := splitSubprotocol(conn.Subprotocol())
+	client.protocol = newProtocol(protocolName)
+	client.codec = newCodec(codecName)
+	client.connectionId = uuid.New().String()
+	client.limiter = clientGroup.limiter.newClientLimiter()
+	client.dispatcher = newDispatcher()
 	return client
 }
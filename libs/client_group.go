@@ -3,21 +3,26 @@ package libs
 import (
 	b64 "encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/nats-io/nats.go"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 )
 
 type MediaServer struct {
-	Id      string `json:"id"`
-	Area    string `json:"area"`
-	Host    string `json:"host"`
-	Name    string `json:"name"`
-	isAlive bool
+	Id   string `json:"id"`
+	Area string `json:"area"`
+	Host string `json:"host"`
+	Name string `json:"name"`
+	//unix seconds, checked when media auth is enabled
+	Timestamp int64 `json:"ts"`
+	isAlive   bool
 }
 
 type ClientGroup struct {
@@ -28,37 +33,119 @@ type ClientGroup struct {
 
 	nc *nats.EncodedConn
 
+	//written by heartbeats and Run, read by clients
+	mediaMu      sync.Mutex
 	mediaServers map[string]*MediaServer
+
+	sessions  *sessionStore
+	limiter   *rateLimiter
+	mediaAuth *mediaVerifier
+	metadata  *metadataValidator
+	//checks requests against the protocol schema, nil unless in development mode
+	requestValidator *requestValidator
+	idempotency      *idempotencyCache
+	//bytes of data in a message request, 0 means only the websocket limit applies
+	maxMessageData int
+
+	//identifies this instance in the session store
+	nodeId          string
+	duplicatePolicy string
 }
 
-func NewClientGroup(natsUrls []string) *ClientGroup {
+type GroupConfig struct {
+	Nats      NatsConfig
+	RateLimit RateLimitConfig
+	MediaAuth MediaAuthConfig
+	Metadata  MetadataConfig
+	//limits of the replicated session attributes
+	Attributes AttributesConfig
+	//what happens when a tokenId connects to a session again
+	DuplicatePolicy string
+	//validates client requests against the protocol schema
+	DevMode bool
+	//how long results of requests with an idempotency key are kept
+	IdempotencyTTL time.Duration
+	MaxMessageData int
+}
+
+const (
+	//the older connection is closed with a `replaced` notification
+	DuplicateKick = "kick"
+	//the newer connection is refused, best-effort: the check uses the replicated
+	//store, so simultaneous upgrades on different nodes can both be admitted
+	DuplicateReject = "reject"
+	//connections live side by side, told apart by connectionId
+	DuplicateMulti = "multi"
+)
+
+func NewClientGroup(config GroupConfig) *ClientGroup {
 	g := &ClientGroup{
 		clients:      make(map[*client]bool),
 		register:     make(chan *client),
 		unregister:   make(chan *client),
 		mediaServers: make(map[string]*MediaServer),
+		limiter:      newRateLimiter(config.RateLimit),
+		idempotency:  newIdempotencyCache(config.IdempotencyTTL),
+		nodeId:       uuid.New().String(),
+	}
+	g.maxMessageData = config.MaxMessageData
+
+	switch config.DuplicatePolicy {
+	case DuplicateKick, DuplicateReject, DuplicateMulti:
+		g.duplicatePolicy = config.DuplicatePolicy
+	default:
+		Log.Fatalf("Unknown duplicate policy %q\n", config.DuplicatePolicy)
+	}
+
+	mediaAuth, err := newMediaVerifier(config.MediaAuth)
+	if err != nil {
+		Log.Fatalf("Media auth config error  %v\n", err)
+	}
+	g.mediaAuth = mediaAuth
+
+	metadata, err := newMetadataValidator(config.Metadata)
+	if err != nil {
+		Log.Fatalf("Metadata config error  %v\n", err)
+	}
+	g.metadata = metadata
+
+	if config.DevMode {
+		validator, err := newRequestValidator()
+		if err != nil {
+			Log.Fatalf("Protocol schema error  %v\n", err)
+		}
+		g.requestValidator = validator
+		Log.Warn("Development mode, requests are validated against the protocol schema")
 	}
 
-	natsUrl := strings.Join(natsUrls, " ,")
+	natsUrl := strings.Join(config.Nats.Urls, " ,")
+	options, err := natsOptions(config.Nats)
+	if err != nil {
+		Log.Fatalf("Nat options error  %v\n", err)
+	}
 	//FIXME: add reconnect
-	nc, err := nats.Connect(natsUrl)
+	nc, err := nats.Connect(natsUrl, options...)
 	if err != nil {
-		Log.Fatalf("Nat connect error  %w\n", err)
+		Log.Fatalf("Nat connect error  %v\n", err)
 	}
 	c, err := nats.NewEncodedConn(nc, nats.JSON_ENCODER)
 	if err != nil {
-		Log.Fatalf("Nat json connect error  %w\n", err)
+		Log.Fatalf("Nat json connect error  %v\n", err)
 	}
 	g.nc = c
 
+	g.sessions = newSessionStore(g.nc, g.nodeId, newAttributesValidator(config.Attributes))
+
 	g.nc.Subscribe("media@heartbeat", func(m *nats.Msg) {
 		//fmt.Println(string(m.Data))
-		var info = &MediaServer{}
-		err := json.Unmarshal(m.Data, info)
+		info, err := g.mediaAuth.openHeartbeat(m.Data)
 		if err != nil {
-			Log.Warnf("Heartbeat json decode error : %w\n", err)
+			Log.Warnf("Heartbeat rejected : %v\n", err)
+			return
 		}
 
+		g.mediaMu.Lock()
+		defer g.mediaMu.Unlock()
 		if media, ok := g.mediaServers[info.Id]; ok {
 			//keepalive
 			media.isAlive = true
@@ -75,6 +162,8 @@ func NewClientGroup(natsUrls []string) *ClientGroup {
 func (g *ClientGroup) Run() {
 	t := time.NewTicker(3 * time.Second)
 	defer t.Stop()
+	sweepTicker := time.NewTicker(time.Minute)
+	defer sweepTicker.Stop()
 
 	for {
 		select {
@@ -86,6 +175,8 @@ func (g *ClientGroup) Run() {
 				delete(g.clients, client)
 			}
 		case <-t.C:
+			g.sessions.heartbeat()
+			g.mediaMu.Lock()
 			for i, e := range g.mediaServers {
 				if e.isAlive {
 					e.isAlive = false
@@ -94,68 +185,196 @@ func (g *ClientGroup) Run() {
 					delete(g.mediaServers, i)
 				}
 			}
+			g.mediaMu.Unlock()
+		case <-sweepTicker.C:
+			g.limiter.sweep()
+			g.idempotency.sweep()
 		}
 	}
 }
 
+type WsConfig struct {
+	Port            int
+	HttpsEnable     bool
+	Cert            string
+	Key             string
+	AllowedOrigins  []string
+	AllowAllOrigins bool
+	ReadBufferSize  int
+	WriteBufferSize int
+	//permissions of clients whose token doesn't carry any
+	DefaultPermissions Permissions
+	APIKeys            []APIKey
+	TokenAPI           TokenAPIConfig
+}
+
 type wsHandler struct {
 	clientGroup *ClientGroup
+	auth        *Authenticator
+	upgrader    *websocket.Upgrader
+	permissions Permissions
 }
 
-func InitWsServer(g *ClientGroup, port int, httpsEnable bool,
-	crtPath string, keyPath string) {
-	address := fmt.Sprintf(":%d", port)
+func InitWsServer(g *ClientGroup, auth *Authenticator, config WsConfig) {
+	address := fmt.Sprintf(":%d", config.Port)
 
-	s := &http.Server{
-		Addr: address,
-		Handler: wsHandler{
-			clientGroup: g,
+	origins := newOriginPolicy(config.AllowedOrigins, config.AllowAllOrigins)
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/schema", &schemaHandler{document: protocolSchema()})
+	if len(config.APIKeys) > 0 {
+		keys := newAPIKeys(config.APIKeys)
+		if auth != nil && auth.canIssue() {
+			mux.Handle("/api/tokens", newTokenHandler(auth, keys, config.TokenAPI))
+		} else {
+			Log.Warn("Token api disabled, auth is off or has no signing key")
+		}
+		mux.Handle(sessionAPIPrefix, &sessionHandler{clientGroup: g, apiKeys: keys})
+	}
+	mux.Handle("/", wsHandler{
+		clientGroup: g,
+		auth:        auth,
+		upgrader: &websocket.Upgrader{
+			ReadBufferSize:  config.ReadBufferSize,
+			WriteBufferSize: config.WriteBufferSize,
+			CheckOrigin:     origins.checkOrigin,
+			Subprotocols:    subprotocols,
 		},
+		permissions: config.DefaultPermissions,
+	})
+
+	s := &http.Server{
+		Addr:           address,
+		Handler:        mux,
 		ReadTimeout:    10 * time.Second,
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
 
-	if httpsEnable {
-		Log.Fatal(s.ListenAndServeTLS(crtPath, keyPath))
+	if config.HttpsEnable {
+		Log.Fatal(s.ListenAndServeTLS(config.Cert, config.Key))
 	} else {
 		Log.Fatal(s.ListenAndServe())
 	}
 }
 
-func (handler wsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	urlQuery := r.URL.RawQuery
-	values, _ := url.ParseQuery(urlQuery)
+// paramsFromQuery decodes the unsigned base64 `params` query, only used when auth is disabled
+func paramsFromQuery(r *http.Request) (*requestParams, error) {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return nil, err
+	}
 	paramsEncodedArr, ok := values["params"]
-	if ok {
-		queryByte, _ := b64.URLEncoding.DecodeString(paramsEncodedArr[0])
-		var params requestParams
-		err := json.Unmarshal(queryByte, &params)
+	if !ok {
+		return nil, errors.New("params missing")
+	}
+	queryByte, err := b64.URLEncoding.DecodeString(paramsEncodedArr[0])
+	if err != nil {
+		return nil, err
+	}
+	var params requestParams
+	err = json.Unmarshal(queryByte, &params)
+	if err != nil {
+		return nil, err
+	}
+	return &params, nil
+}
+
+func (handler wsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !handler.clientGroup.limiter.allowUpgrade(r) {
+		Log.Warnf("Upgrade from %s rate limited\n", r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	var params *requestParams
+	permissions := handler.permissions
+	if handler.auth != nil {
+		claims, err := handler.auth.verify(tokenFromRequest(r))
 		if err != nil {
-			//TODO(CC): response error
-			Log.Warnf("Json decode error : %w\n",err)
+			Log.Warnf("Auth failed : %v\n", err)
+			if err == errTokenForbidden {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			} else {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			}
 			return
 		}
-		upgrade := websocket.Upgrader{
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
-			CheckOrigin:     func(r *http.Request) bool { return true },
+		params = &requestParams{
+			SessionId: claims.SessionId,
+			TokenId:   claims.TokenId,
+			Metadata:  claims.Metadata,
 		}
-
-		header := http.Header{}
-		conn, err := upgrade.Upgrade(w, r, header)
-
+		if claims.Permissions != nil {
+			permissions = *claims.Permissions
+		}
+	} else {
+		var err error
+		params, err = paramsFromQuery(r)
 		if err != nil {
-			Log.Warnf("Websocket err : %w\n", err)
+			Log.Warnf("Params decode error : %v\n", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
+	}
 
-		client := newClient(handler.clientGroup, conn, params.TokenId, params.SessionId, params.Metadata)
-		handler.clientGroup.register <- client
+	if !subjectToken(params.SessionId) || !subjectToken(params.TokenId) {
+		Log.Warnf("Invalid sessionId %q or tokenId %q\n", params.SessionId, params.TokenId)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	existing := handler.clientGroup.sessions.connections(params.SessionId, params.TokenId)
+	if len(existing) > 0 && handler.clientGroup.duplicatePolicy == DuplicateReject {
+		Log.Warnf("%s is already in session %s\n", params.TokenId, params.SessionId)
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		return
+	}
+
+	query := r.URL.Query()
+	handshake, signalErr := handshakeFromQuery(query.Get("version"), query.Get("capabilities"))
+	if signalErr != nil {
+		Log.Warnf("Handshake of %s rejected : %v\n", params.TokenId, signalErr)
+		http.Error(w, signalErr.Message, signalErr.Code)
+		return
+	}
+
+	password := query.Get("password")
+	if !handler.clientGroup.sessions.admit(params.SessionId, params.TokenId, password) {
+		Log.Warnf("%s is not admitted to session %s\n", params.TokenId, params.SessionId)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	err := handler.clientGroup.metadata.validateParticipant(params.Metadata)
+	if err != nil {
+		Log.Warnf("Metadata of %s rejected : %v\n", params.TokenId, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	header := http.Header{}
+	conn, err := handler.upgrader.Upgrade(w, r, header)
+
+	if err != nil {
+		Log.Warnf("Websocket err : %v\n", err)
+		return
+	}
 
-		go client.processPump()
-		go client.writePump()
-		go client.readPump()
+	client := newClient(handler.clientGroup, conn, params.TokenId, params.SessionId, params.Metadata, &permissions)
+	client.password = password
+	client.handshake = handshake
+	handler.clientGroup.register <- client
+	client.subscribeConnection()
+	handler.clientGroup.sessions.join(client)
+
+	if handler.clientGroup.duplicatePolicy == DuplicateKick {
+		for _, connectionId := range existing {
+			client.publish2Connection(connectionId, "replaced", &emptyNotice{})
+		}
 	}
 
+	go client.processPump()
+	go client.writePump()
+	go client.readPump()
 }
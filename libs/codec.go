@@ -0,0 +1,190 @@
+package libs
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// codecs of binary subprotocols, clients that ask for none speak json
+const (
+	subprotocolMsgpack = "msgpack"
+	subprotocolCBOR    = "cbor"
+)
+
+// subprotocols offered on upgrade, a codec is combined with a protocol as "jsonrpc-2.0+msgpack"
+var subprotocols = []string{
+	subprotocolJSONRPC,
+	subprotocolMsgpack,
+	subprotocolCBOR,
+	subprotocolJSONRPC + "+" + subprotocolMsgpack,
+	subprotocolJSONRPC + "+" + subprotocolCBOR,
+}
+
+// splitSubprotocol returns the protocol and codec of a negotiated subprotocol
+func splitSubprotocol(subprotocol string) (string, string) {
+	if i := strings.IndexByte(subprotocol, '+'); i >= 0 {
+		return subprotocol[:i], subprotocol[i+1:]
+	}
+	switch subprotocol {
+	case subprotocolMsgpack, subprotocolCBOR:
+		return "", subprotocol
+	}
+	return subprotocol, ""
+}
+
+// codec is the encoding of frames on a connection, messages are encoded directly by their json tags,
+// received binary frames are turned into json so protocols and requests stay json
+type codec interface {
+	messageType() int
+	marshal(v interface{}) ([]byte, error)
+	toJSON(data []byte) ([]byte, error)
+}
+
+func newCodec(name string) codec {
+	switch name {
+	case subprotocolMsgpack:
+		return msgpackCodec{}
+	case subprotocolCBOR:
+		return cborCodec{}
+	}
+	return jsonCodec{}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) messageType() int {
+	return websocket.TextMessage
+}
+
+func (jsonCodec) marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) toJSON(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) messageType() int {
+	return websocket.BinaryMessage
+}
+
+func (msgpackCodec) marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := msgpack.NewEncoder(&buf)
+	encoder.SetCustomStructTag("json")
+	//numbers relayed from json are floats, whole ones are sent as integers
+	encoder.UseCompactFloats(true)
+	err := encoder.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) toJSON(data []byte) ([]byte, error) {
+	var value interface{}
+	err := msgpack.Unmarshal(data, &value)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+type cborCodec struct{}
+
+var cborDecMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+}.DecMode()
+
+func (cborCodec) messageType() int {
+	return websocket.BinaryMessage
+}
+
+// marshal falls back to json tags, numbers relayed from json may stay floats
+func (cborCodec) marshal(v interface{}) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+func (cborCodec) toJSON(data []byte) ([]byte, error) {
+	var value interface{}
+	err := cborDecMode.Unmarshal(data, &value)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// rawJSON is json passed through to clients unchanged,
+// binary codecs encode the value it holds instead of its bytes
+type rawJSON []byte
+
+func (r rawJSON) MarshalJSON() ([]byte, error) {
+	if len(r) == 0 {
+		return []byte("null"), nil
+	}
+	return r, nil
+}
+
+func (r rawJSON) EncodeMsgpack(encoder *msgpack.Encoder) error {
+	value, err := r.value()
+	if err != nil {
+		return err
+	}
+	return encoder.Encode(value)
+}
+
+func (r rawJSON) MarshalCBOR() ([]byte, error) {
+	value, err := r.value()
+	if err != nil {
+		return nil, err
+	}
+	return cbor.Marshal(value)
+}
+
+func (r rawJSON) value() (interface{}, error) {
+	if len(r) == 0 {
+		return nil, nil
+	}
+	return decodeJSONValue(r)
+}
+
+// decodeJSONValue decodes json into maps, slices and scalars with integers kept as integers
+func decodeJSONValue(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+	return plainNumbers(value), nil
+}
+
+// plainNumbers keeps integers as integers, json would turn them all into floats
+func plainNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = plainNumbers(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = plainNumbers(value)
+		}
+	}
+	return v
+}
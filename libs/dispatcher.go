@@ -0,0 +1,94 @@
+package libs
+
+import "sync"
+
+// maxConcurrentRequests bounds the requests of one connection in flight at once
+const maxConcurrentRequests = 4
+
+// dispatcher runs the requests of a connection concurrently,
+// requests with the same order key run in arrival order and barriers run alone
+type dispatcher struct {
+	slots   chan struct{}
+	running sync.WaitGroup
+
+	mu sync.Mutex
+	//closed when the last request of a key is done
+	tails map[string]chan struct{}
+}
+
+func newDispatcher() *dispatcher {
+	return &dispatcher{
+		slots: make(chan struct{}, maxConcurrentRequests),
+		tails: map[string]chan struct{}{},
+	}
+}
+
+// orderKey is what a request has to stay ordered with, empty means it is a barrier
+func orderKey(req request) string {
+	switch r := req.(type) {
+	case *dtlsRequest:
+		return "transport:" + r.TransportId
+	case *publishRequest:
+		return "transport:" + r.TransportId
+	case *unpublishRequest:
+		return "sender:" + r.SenderId
+	case *subscribeRequest:
+		return "sender:" + r.SenderId
+	case *unsubscribeRequest:
+		return "sender:" + r.SenderId
+	case *pauseRequest:
+		return "sender:" + r.SenderId
+	case *setAccessRequest:
+		return "access"
+	case *setAttributesRequest, *getAttributesRequest:
+		return "attributes"
+	case *kickRequest, *muteRemoteRequest, *endSessionRequest:
+		return "moderation"
+	case *messageRequest:
+		//messages arrive in the order they were sent
+		return "message"
+	case *updateMetadataRequest:
+		if r.SenderId != "" {
+			return "sender:" + r.SenderId
+		}
+		return "metadata"
+	}
+	//hello and join change the state every other request relies on
+	return ""
+}
+
+// dispatch runs fn after the requests it is ordered with, it blocks while all slots are taken
+func (d *dispatcher) dispatch(key string, fn func()) {
+	if key == "" {
+		d.running.Wait()
+		fn()
+		return
+	}
+
+	d.slots <- struct{}{}
+	d.running.Add(1)
+
+	d.mu.Lock()
+	prev := d.tails[key]
+	done := make(chan struct{})
+	d.tails[key] = done
+	d.mu.Unlock()
+
+	go func() {
+		defer func() {
+			d.mu.Lock()
+			if d.tails[key] == done {
+				delete(d.tails, key)
+			}
+			d.mu.Unlock()
+			close(done)
+			d.running.Done()
+			<-d.slots
+		}()
+
+		if prev != nil {
+			<-prev
+		}
+		fn()
+	}()
+}
@@ -0,0 +1,97 @@
+package libs
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOrderKey(t *testing.T) {
+	tests := []struct {
+		name string
+		req  request
+		key  string
+	}{
+		{"hello is a barrier", &helloRequest{}, ""},
+		{"join is a barrier", &joinRequest{}, ""},
+		{"dtls by transport", &dtlsRequest{TransportId: "t"}, "transport:t"},
+		{"publish by transport", &publishRequest{TransportId: "t"}, "transport:t"},
+		{"subscribe by sender", &subscribeRequest{SenderId: "s"}, "sender:s"},
+		{"sender metadata by sender", &updateMetadataRequest{SenderId: "s"}, "sender:s"},
+		{"participant metadata", &updateMetadataRequest{}, "metadata"},
+		{"messages", &messageRequest{}, "message"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := orderKey(tt.req); got != tt.key {
+				t.Fatalf("orderKey = %q, want %q", got, tt.key)
+			}
+		})
+	}
+}
+
+func TestDispatcherKeepsOrderOfKey(t *testing.T) {
+	d := newDispatcher()
+
+	var mu sync.Mutex
+	var order []int
+	for i := 0; i < 20; i++ {
+		i := i
+		d.dispatch("key", func() {
+			//later requests would overtake without ordering
+			time.Sleep(time.Duration(20-i) * 100 * time.Microsecond)
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+		})
+	}
+	d.dispatch("", func() {})
+
+	for i, got := range order {
+		if got != i {
+			t.Fatalf("order = %v", order)
+		}
+	}
+	if len(order) != 20 {
+		t.Fatalf("%d of 20 requests ran", len(order))
+	}
+}
+
+func TestDispatcherRunsKeysConcurrently(t *testing.T) {
+	d := newDispatcher()
+
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	d.dispatch("a", func() {
+		<-release
+		close(finished)
+	})
+	d.dispatch("b", func() {
+		close(release)
+	})
+
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("request of key b waited for key a")
+	}
+}
+
+func TestDispatcherBarrierWaitsForRunning(t *testing.T) {
+	d := newDispatcher()
+
+	var done int32
+	for _, key := range []string{"a", "b", "c"} {
+		d.dispatch(key, func() {
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&done, 1)
+		})
+	}
+	d.dispatch("", func() {
+		if n := atomic.LoadInt32(&done); n != 3 {
+			t.Errorf("barrier ran with %d of 3 requests done", n)
+		}
+	})
+}
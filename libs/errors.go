@@ -0,0 +1,71 @@
+package libs
+
+import "fmt"
+
+// error codes of the client protocol, clients may rely on them
+const (
+	codeBadRequest         = 400
+	codeUnauthorized       = 401
+	codeForbidden          = 403
+	codeNotFound           = 404
+	codeRequestTimeout     = 408
+	codeConflict           = 409
+	codeClientGone         = 410
+	codePayloadTooLarge    = 413
+	codeUnsupportedVersion = 426
+	codeTooManyRequests    = 429
+	codeCancelled          = 499
+	codeInternalError      = 500
+	codeNotSupported       = 501
+	codeMediaError         = 502
+	codeNoMediaServer      = 503
+	codeMediaTimeout       = 504
+)
+
+// signalError is the `error` of a response:
+//
+//	{"method":"response","id":1,"error":{"code":503,"message":"no media server"}}
+type signalError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	//finer code for json-rpc clients, 0 means Code is used
+	rpcCode int
+}
+
+// reserved codes of JSON-RPC 2.0
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+)
+
+func (e *signalError) Error() string {
+	return fmt.Sprintf("%d %s", e.Code, e.Message)
+}
+
+func newSignalError(code int, format string, v ...interface{}) *signalError {
+	return &signalError{Code: code, Message: fmt.Sprintf(format, v...)}
+}
+
+func errParse() *signalError {
+	return &signalError{Code: codeBadRequest, Message: "invalid json", rpcCode: rpcParseError}
+}
+
+func errInvalidRequest(format string, v ...interface{}) *signalError {
+	err := newSignalError(codeBadRequest, format, v...)
+	err.rpcCode = rpcInvalidRequest
+	return err
+}
+
+func errUnknownEvent(event string) *signalError {
+	err := newSignalError(codeBadRequest, "unknown event %q", event)
+	err.rpcCode = rpcMethodNotFound
+	return err
+}
+
+func errInvalidParams(format string, v ...interface{}) *signalError {
+	err := newSignalError(codeBadRequest, format, v...)
+	err.rpcCode = rpcInvalidParams
+	return err
+}
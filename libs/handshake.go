@@ -0,0 +1,85 @@
+package libs
+
+import (
+	"strconv"
+	"strings"
+)
+
+// version of the signaling protocol, bumped on breaking changes
+const (
+	protocolVersion    = 1
+	minProtocolVersion = 1
+)
+
+// capabilities are optional features, used only when both sides support them
+const (
+	//"replaced" notification before a duplicate connection is closed
+	capReplaced = "replaced"
+	//requests sent by the server, answered by the client
+	capServerRequests = "serverRequests"
+	//participants and senders in the join response instead of one message per peer
+	capRoster = "roster"
+)
+
+var serverCapabilities = []string{capReplaced, capServerRequests, capRoster}
+
+// handshake is what a client and the server agreed on,
+// clients that never say hello get the minimum version without capabilities
+type handshake struct {
+	version      int
+	capabilities map[string]bool
+}
+
+func defaultHandshake() handshake {
+	return handshake{version: minProtocolVersion, capabilities: map[string]bool{}}
+}
+
+// negotiate picks the highest version both sides speak and the capabilities both support
+func negotiate(version int, capabilities []string) (handshake, *signalError) {
+	if version < minProtocolVersion {
+		return handshake{}, newSignalError(codeUnsupportedVersion, "unsupported protocol version %d, minimum is %d", version, minProtocolVersion)
+	}
+	if version > protocolVersion {
+		version = protocolVersion
+	}
+
+	h := handshake{version: version, capabilities: map[string]bool{}}
+	for _, name := range capabilities {
+		for _, supported := range serverCapabilities {
+			if name == supported {
+				h.capabilities[name] = true
+			}
+		}
+	}
+	return h, nil
+}
+
+// handshakeFromQuery reads the optional `version` and `capabilities` upgrade params
+func handshakeFromQuery(version string, capabilities string) (handshake, *signalError) {
+	if version == "" {
+		return defaultHandshake(), nil
+	}
+	v, err := strconv.Atoi(version)
+	if err != nil {
+		return handshake{}, newSignalError(codeBadRequest, "invalid protocol version %q", version)
+	}
+	var names []string
+	if capabilities != "" {
+		names = strings.Split(capabilities, ",")
+	}
+	return negotiate(v, names)
+}
+
+func (h handshake) response() helloResponse {
+	capabilities := []string{}
+	for _, name := range serverCapabilities {
+		if h.capabilities[name] {
+			capabilities = append(capabilities, name)
+		}
+	}
+	return helloResponse{
+		Version:      h.version,
+		MinVersion:   minProtocolVersion,
+		Capabilities: capabilities,
+	}
+}
@@ -0,0 +1,77 @@
+package libs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name         string
+		version      int
+		capabilities []string
+		wantVersion  int
+		wantCaps     []string
+		wantCode     int
+	}{
+		{"current version", protocolVersion, nil, protocolVersion, []string{}, 0},
+		{"newer client", protocolVersion + 1, nil, protocolVersion, []string{}, 0},
+		{"too old", minProtocolVersion - 1, nil, 0, nil, codeUnsupportedVersion},
+		{"known capabilities", protocolVersion, []string{capRoster, capReplaced}, protocolVersion, []string{capReplaced, capRoster}, 0},
+		{"unknown capability", protocolVersion, []string{"teleport", capServerRequests}, protocolVersion, []string{capServerRequests}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := negotiate(tt.version, tt.capabilities)
+			if tt.wantCode != 0 {
+				if err == nil || err.Code != tt.wantCode {
+					t.Fatalf("negotiate error = %v, want code %d", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("negotiate failed : %v", err)
+			}
+			if h.version != tt.wantVersion {
+				t.Fatalf("version = %d, want %d", h.version, tt.wantVersion)
+			}
+			if got := h.response().Capabilities; !reflect.DeepEqual(got, tt.wantCaps) {
+				t.Fatalf("capabilities = %v, want %v", got, tt.wantCaps)
+			}
+		})
+	}
+}
+
+func TestHandshakeFromQuery(t *testing.T) {
+	tests := []struct {
+		name         string
+		version      string
+		capabilities string
+		wantCode     int
+		wantRoster   bool
+	}{
+		{"no hello", "", capRoster, 0, false},
+		{"with capabilities", "1", capRoster + "," + capReplaced, 0, true},
+		{"not a number", "one", "", codeBadRequest, false},
+		{"too old", "0", "", codeUnsupportedVersion, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := handshakeFromQuery(tt.version, tt.capabilities)
+			if tt.wantCode != 0 {
+				if err == nil || err.Code != tt.wantCode {
+					t.Fatalf("error = %v, want code %d", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("handshakeFromQuery failed : %v", err)
+			}
+			if h.capabilities[capRoster] != tt.wantRoster {
+				t.Fatalf("roster = %v, want %v", h.capabilities[capRoster], tt.wantRoster)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package libs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// idempotencyEntry is the outcome of a request with an idempotency key
+type idempotencyEntry struct {
+	event string
+	//sha256 of the request data, a repeat has to send the same
+	hash [sha256.Size]byte
+	//own transport of the client the request ran on, closing it drops the entry
+	transportId string
+	//closed once result or err is set
+	done    chan struct{}
+	result  interface{}
+	err     *signalError
+	expires time.Time
+}
+
+// idempotencyCache keeps recent results per session and token so a resent request
+// gets the original response, it's local to this instance
+type idempotencyCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+}
+
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{ttl: ttl, entries: map[string]*idempotencyEntry{}}
+}
+
+// begin stores entry under a key unless the key is taken, it returns the entry of the key
+// and whether the request was seen before
+func (c *idempotencyCache) begin(key string, entry *idempotencyEntry) (*idempotencyEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if existing, ok := c.entries[key]; ok {
+		return existing, true
+	}
+	entry.done = make(chan struct{})
+	c.entries[key] = entry
+	return entry, false
+}
+
+// finish keeps a result until the ttl passes, failed requests may be retried right away
+func (c *idempotencyCache) finish(key string, entry *idempotencyEntry, err *signalError) {
+	c.mu.Lock()
+	entry.err = err
+	entry.expires = time.Now().Add(c.ttl)
+	if err != nil && c.entries[key] == entry {
+		delete(c.entries, key)
+	}
+	c.mu.Unlock()
+	close(entry.done)
+}
+
+// dropTransport forgets the results of a closed transport, their media objects are gone with it
+func (c *idempotencyCache) dropTransport(transportId string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.entries {
+		if entry.transportId == transportId {
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (c *idempotencyCache) sweep() {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.entries {
+		if !entry.expires.IsZero() && now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// idempotent reports whether a request may carry an idempotency key, only requests
+// creating media objects do, replaying join or hello would skip their connection state
+func idempotent(req request) bool {
+	switch req.(type) {
+	case *publishRequest, *subscribeRequest:
+		return true
+	}
+	return false
+}
+
+// conflict returns an error when a repeat differs from the request that used the key first
+func (e *idempotencyEntry) conflict(repeat *idempotencyEntry) *signalError {
+	if e.event != repeat.event {
+		return newSignalError(codeConflict, "idempotency key used by %s", e.event)
+	}
+	if e.hash != repeat.hash {
+		return newSignalError(codeConflict, "idempotency key used with other data")
+	}
+	return nil
+}
+
+type idempotencyContextKey struct{}
+
+// respond answers a request and remembers the result for repeats of its idempotency key
+func (c *client) respond(ctx context.Context, id json.RawMessage, result interface{}) {
+	if entry, ok := ctx.Value(idempotencyContextKey{}).(*idempotencyEntry); ok {
+		entry.result = result
+	}
+	c.responseClient(id, result)
+}
+
+// handleIdempotent runs a request once per idempotency key of the session, token and
+// transport, repeats get the original response without calling the media server again,
+// keying by transport keeps the devices of a token apart under the multi policy
+func (c *client) handleIdempotent(ctx context.Context, msg *clientMessage, req request) *signalError {
+	cache := c.clientGroup.idempotency
+	fresh := &idempotencyEntry{
+		event:       msg.Event,
+		hash:        sha256.Sum256(msg.Data),
+		transportId: c.idempotencyTransport(req),
+	}
+	key := c.sessionId + "/" + c.tokenId + "/" + fresh.transportId + "/" + msg.IdempotencyKey
+
+	entry, repeated := cache.begin(key, fresh)
+	if repeated {
+		if err := entry.conflict(fresh); err != nil {
+			return err
+		}
+		select {
+		case <-entry.done:
+		case <-ctx.Done():
+			return contextError(ctx)
+		}
+		if entry.err != nil {
+			return entry.err
+		}
+		Log.Debugf("%s repeated %s, original response sent\n", c.tokenId, msg.Event)
+		c.responseClient(msg.Id, entry.result)
+		return nil
+	}
+
+	err := c.handleRequest(context.WithValue(ctx, idempotencyContextKey{}, entry), msg.Id, msg.Event, req)
+	cache.finish(key, entry, err)
+	return err
+}
+
+// idempotencyTransport is the transport of the client a request creates media objects on
+func (c *client) idempotencyTransport(req request) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if _, ok := req.(*subscribeRequest); ok {
+		return c.subTransId
+	}
+	return c.pubTransId
+}
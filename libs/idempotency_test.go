@@ -0,0 +1,117 @@
+package libs
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+)
+
+func TestIdempotent(t *testing.T) {
+	tests := []struct {
+		name string
+		req  request
+		ok   bool
+	}{
+		{"publish", &publishRequest{}, true},
+		{"subscribe", &subscribeRequest{}, true},
+		{"join", &joinRequest{}, false},
+		{"hello", &helloRequest{}, false},
+		{"unpublish", &unpublishRequest{}, false},
+		{"setAttributes", &setAttributesRequest{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := idempotent(tt.req); got != tt.ok {
+				t.Fatalf("idempotent = %v, want %v", got, tt.ok)
+			}
+		})
+	}
+}
+
+func TestIdempotencyCache(t *testing.T) {
+	tests := []struct {
+		name string
+		//finishes the first request with this error
+		err *signalError
+		//sweeps after the ttl passed
+		expire bool
+		//closes the transport of the first request
+		drop         bool
+		wantRepeated bool
+	}{
+		{"repeat of a success", nil, false, false, true},
+		{"retry of a failure", newSignalError(codeMediaError, "failed"), false, false, false},
+		{"repeat after ttl", nil, true, false, false},
+		{"repeat after transport closed", nil, false, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ttl := time.Hour
+			if tt.expire {
+				ttl = time.Millisecond
+			}
+			cache := newIdempotencyCache(ttl)
+
+			entry, repeated := cache.begin("key", &idempotencyEntry{event: "publish", transportId: "transport"})
+			if repeated {
+				t.Fatal("first request reported as repeated")
+			}
+			//a repeat while running waits for the same entry
+			if running, repeated := cache.begin("key", &idempotencyEntry{event: "publish"}); !repeated || running != entry {
+				t.Fatal("repeat while running got another entry")
+			}
+
+			entry.result = publishResponse{SenderId: "sender"}
+			cache.finish("key", entry, tt.err)
+			select {
+			case <-entry.done:
+			default:
+				t.Fatal("finished entry is not done")
+			}
+
+			if tt.expire {
+				time.Sleep(5 * time.Millisecond)
+			}
+			cache.sweep()
+			if tt.drop {
+				cache.dropTransport("transport")
+			}
+
+			again, repeated := cache.begin("key", &idempotencyEntry{event: "publish"})
+			if repeated != tt.wantRepeated {
+				t.Fatalf("repeated = %v, want %v", repeated, tt.wantRepeated)
+			}
+			if repeated && again.result != entry.result {
+				t.Fatalf("repeat got result %v", again.result)
+			}
+		})
+	}
+}
+
+func TestIdempotencyConflict(t *testing.T) {
+	first := &idempotencyEntry{event: "publish", hash: sha256.Sum256([]byte(`{"transportId":"t"}`))}
+	tests := []struct {
+		name     string
+		event    string
+		data     string
+		conflict bool
+	}{
+		{"same request", "publish", `{"transportId":"t"}`, false},
+		{"other event", "subscribe", `{"transportId":"t"}`, true},
+		{"other data", "publish", `{"transportId":"u"}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := first.conflict(&idempotencyEntry{event: tt.event, hash: sha256.Sum256([]byte(tt.data))})
+			if tt.conflict && (err == nil || err.Code != codeConflict) {
+				t.Fatalf("error = %v, want code %d", err, codeConflict)
+			}
+			if !tt.conflict && err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+		})
+	}
+}
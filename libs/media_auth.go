@@ -0,0 +1,184 @@
+package libs
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// heartbeats older than this are treated as replayed
+const heartbeatMaxAge = 30 * time.Second
+
+type MediaKey struct {
+	Id string
+	//base64 ed25519 public key
+	PublicKey string
+}
+
+type MediaAuthConfig struct {
+	Enable bool
+	//hmac or ed25519
+	Mode string
+	//shared hmac secret
+	Secret string
+	//registered ed25519 keys
+	Keys []MediaKey
+}
+
+// signedMessage wraps heartbeats and media.<id> responses when media auth is enabled,
+// signature is base64 of the hmac-sha256 or ed25519 signature over payload
+type signedMessage struct {
+	Payload   json.RawMessage `json:"payload"`
+	Signature string          `json:"signature"`
+}
+
+// signedResponse is the part of a response payload binding it to its request
+type signedResponse struct {
+	Nonce string `json:"nonce"`
+}
+
+type mediaVerifier struct {
+	enable     bool
+	mode       string
+	secret     []byte
+	publicKeys map[string]ed25519.PublicKey
+}
+
+var errBadSignature = errors.New("bad signature")
+
+func newMediaVerifier(config MediaAuthConfig) (*mediaVerifier, error) {
+	v := &mediaVerifier{
+		enable:     config.Enable,
+		mode:       config.Mode,
+		publicKeys: make(map[string]ed25519.PublicKey),
+	}
+	if !config.Enable {
+		return v, nil
+	}
+
+	switch config.Mode {
+	case "hmac":
+		if config.Secret == "" {
+			return nil, errors.New("media auth secret is empty")
+		}
+		v.secret = []byte(config.Secret)
+	case "ed25519":
+		for _, k := range config.Keys {
+			key, err := b64.StdEncoding.DecodeString(k.PublicKey)
+			if err != nil || len(key) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("bad public key of media %s", k.Id)
+			}
+			v.publicKeys[k.Id] = ed25519.PublicKey(key)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported media auth mode %q", config.Mode)
+	}
+	return v, nil
+}
+
+func (v *mediaVerifier) verify(mediaId string, payload []byte, signature string) error {
+	sig, err := b64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errBadSignature
+	}
+
+	switch v.mode {
+	case "hmac":
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(payload)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return errBadSignature
+		}
+	case "ed25519":
+		key, ok := v.publicKeys[mediaId]
+		if !ok {
+			return fmt.Errorf("media %s not registered", mediaId)
+		}
+		if !ed25519.Verify(key, payload, sig) {
+			return errBadSignature
+		}
+	}
+	return nil
+}
+
+// nonce returns a fresh request nonce, empty when media auth is disabled
+func (v *mediaVerifier) nonce() string {
+	if !v.enable {
+		return ""
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return b64.RawURLEncoding.EncodeToString(b)
+}
+
+// open verifies a response from media server mediaId to the request with nonce and returns its payload,
+// a signed response of another request is rejected, messages pass through unchanged when media auth is disabled
+func (v *mediaVerifier) open(mediaId string, nonce string, data []byte) ([]byte, error) {
+	if !v.enable {
+		return data, nil
+	}
+
+	var msg signedMessage
+	err := json.Unmarshal(data, &msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg.Payload) == 0 || msg.Signature == "" {
+		return nil, errors.New("unsigned message")
+	}
+
+	err = v.verify(mediaId, msg.Payload, msg.Signature)
+	if err != nil {
+		return nil, err
+	}
+
+	var response signedResponse
+	err = json.Unmarshal(msg.Payload, &response)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(response.Nonce), []byte(nonce)) {
+		return nil, errors.New("response to another request")
+	}
+	return msg.Payload, nil
+}
+
+// openHeartbeat decodes a heartbeat, the media id is taken from the payload
+// before the signature is checked against the key of that id
+func (v *mediaVerifier) openHeartbeat(data []byte) (*MediaServer, error) {
+	info := &MediaServer{}
+	if !v.enable {
+		err := json.Unmarshal(data, info)
+		return info, err
+	}
+
+	var msg signedMessage
+	err := json.Unmarshal(data, &msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg.Payload) == 0 || msg.Signature == "" {
+		return nil, errors.New("unsigned heartbeat")
+	}
+	err = json.Unmarshal(msg.Payload, info)
+	if err != nil {
+		return nil, err
+	}
+
+	err = v.verify(info.Id, msg.Payload, msg.Signature)
+	if err != nil {
+		return nil, err
+	}
+
+	age := time.Since(time.Unix(info.Timestamp, 0))
+	if age > heartbeatMaxAge || age < -heartbeatMaxAge {
+		return nil, errors.New("stale heartbeat")
+	}
+	return info, nil
+}
@@ -0,0 +1,147 @@
+package libs
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testSigner signs payloads the way a media server does
+type testSigner struct {
+	verifier *mediaVerifier
+	sign     func(payload []byte) []byte
+}
+
+func newTestSigners(t *testing.T) map[string]testSigner {
+	hmacVerifier, err := newMediaVerifier(MediaAuthConfig{Enable: true, Mode: "hmac", Secret: "secret"})
+	if err != nil {
+		t.Fatalf("hmac verifier error : %v", err)
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519 key error : %v", err)
+	}
+	ed25519Verifier, err := newMediaVerifier(MediaAuthConfig{Enable: true, Mode: "ed25519", Keys: []MediaKey{
+		{Id: "media", PublicKey: b64.StdEncoding.EncodeToString(publicKey)},
+	}})
+	if err != nil {
+		t.Fatalf("ed25519 verifier error : %v", err)
+	}
+
+	return map[string]testSigner{
+		"hmac": {hmacVerifier, func(payload []byte) []byte {
+			mac := hmac.New(sha256.New, []byte("secret"))
+			mac.Write(payload)
+			return mac.Sum(nil)
+		}},
+		"ed25519": {ed25519Verifier, func(payload []byte) []byte {
+			return ed25519.Sign(privateKey, payload)
+		}},
+	}
+}
+
+// signed wraps payload, tamper changes the payload after signing
+func (s testSigner) signed(payload string, tamper bool) []byte {
+	signature := b64.StdEncoding.EncodeToString(s.sign([]byte(payload)))
+	if tamper {
+		payload = payload[:len(payload)-1] + ` ,"x":1}`
+	}
+	data, _ := json.Marshal(signedMessage{Payload: json.RawMessage(payload), Signature: signature})
+	return data
+}
+
+func TestMediaVerifierOpen(t *testing.T) {
+	tests := []struct {
+		name    string
+		mediaId string
+		nonce   string
+		payload string
+		tamper  bool
+		//sent without signature
+		unsigned bool
+		ok       bool
+	}{
+		{"valid", "media", "n1", `{"method":"response","nonce":"n1","data":{}}`, false, false, true},
+		{"nonce mismatch", "media", "n2", `{"method":"response","nonce":"n1","data":{}}`, false, false, false},
+		{"missing nonce", "media", "n1", `{"method":"response","data":{}}`, false, false, false},
+		{"tampered payload", "media", "n1", `{"method":"response","nonce":"n1","data":{}}`, true, false, false},
+		{"unsigned", "media", "n1", `{"method":"response","nonce":"n1","data":{}}`, false, true, false},
+	}
+
+	for mode, signer := range newTestSigners(t) {
+		for _, tt := range tests {
+			t.Run(mode+"/"+tt.name, func(t *testing.T) {
+				data := signer.signed(tt.payload, tt.tamper)
+				if tt.unsigned {
+					data = []byte(tt.payload)
+				}
+				payload, err := signer.verifier.open(tt.mediaId, tt.nonce, data)
+				if tt.ok && (err != nil || string(payload) != tt.payload) {
+					t.Fatalf("open = %s, %v, want %s", payload, err, tt.payload)
+				}
+				if !tt.ok && err == nil {
+					t.Fatal("open accepted the response")
+				}
+			})
+		}
+	}
+
+	t.Run("ed25519/unregistered media", func(t *testing.T) {
+		signer := newTestSigners(t)["ed25519"]
+		payload := `{"method":"response","nonce":"n1","data":{}}`
+		if _, err := signer.verifier.open("other", "n1", signer.signed(payload, false)); err == nil {
+			t.Fatal("open accepted a response of an unregistered media server")
+		}
+	})
+}
+
+func TestMediaVerifierOpenHeartbeat(t *testing.T) {
+	now := time.Now().Unix()
+	tests := []struct {
+		name      string
+		timestamp int64
+		tamper    bool
+		ok        bool
+	}{
+		{"fresh", now, false, true},
+		{"stale", now - 2*int64(heartbeatMaxAge/time.Second), false, false},
+		{"from the future", now + 2*int64(heartbeatMaxAge/time.Second), false, false},
+		{"tampered", now, true, false},
+	}
+
+	for mode, signer := range newTestSigners(t) {
+		for _, tt := range tests {
+			t.Run(mode+"/"+tt.name, func(t *testing.T) {
+				payload := fmt.Sprintf(`{"id":"media","host":"h","ts":%d}`, tt.timestamp)
+				info, err := signer.verifier.openHeartbeat(signer.signed(payload, tt.tamper))
+				if tt.ok && (err != nil || info.Id != "media" || info.Host != "h") {
+					t.Fatalf("openHeartbeat = %+v, %v", info, err)
+				}
+				if !tt.ok && err == nil {
+					t.Fatal("openHeartbeat accepted the heartbeat")
+				}
+			})
+		}
+	}
+}
+
+func TestMediaVerifierDisabled(t *testing.T) {
+	v, err := newMediaVerifier(MediaAuthConfig{})
+	if err != nil {
+		t.Fatalf("verifier error : %v", err)
+	}
+	if nonce := v.nonce(); nonce != "" {
+		t.Fatalf("nonce = %q without media auth", nonce)
+	}
+	data := []byte(`{"method":"response","data":{}}`)
+	if payload, err := v.open("media", "", data); err != nil || string(payload) != string(data) {
+		t.Fatalf("open = %s, %v, want the data unchanged", payload, err)
+	}
+}
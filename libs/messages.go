@@ -0,0 +1,569 @@
+package libs
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// request is the typed data of a client request
+type request interface {
+	validate() error
+}
+
+type helloRequest struct {
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+type helloResponse struct {
+	Version      int      `json:"version"`
+	MinVersion   int      `json:"minVersion"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// cancelRequest cancels a request of the same client by its id
+type cancelRequest struct {
+	Id json.RawMessage `json:"id"`
+}
+
+type joinRequest struct {
+	Pub     bool   `json:"pub,omitempty"`
+	Sub     bool   `json:"sub,omitempty"`
+	MediaId string `json:"mediaId,omitempty"`
+}
+
+type joinResponse struct {
+	Codecs interface{} `json:"codecs"`
+	Pub    interface{} `json:"pub,omitempty"`
+	Sub    interface{} `json:"sub,omitempty"`
+	//clients with the roster capability, changes follow as notifications
+	Roster     []rosterParticipant `json:"roster,omitempty"`
+	Attributes *attributesResponse `json:"attributes,omitempty"`
+}
+
+// rosterParticipant is another participant of the session with its published senders
+type rosterParticipant struct {
+	TokenId      string                 `json:"tokenId"`
+	ConnectionId string                 `json:"connectionId"`
+	Metadata     map[string]string      `json:"metadata"`
+	Senders      []*publishNotification `json:"senders"`
+}
+
+type setAccessRequest struct {
+	Password string   `json:"password,omitempty"`
+	Invites  []string `json:"invites,omitempty"`
+}
+
+type dtlsRequest struct {
+	TransportId    string      `json:"transportId"`
+	DtlsParameters interface{} `json:"dtlsParameters"`
+}
+
+type publishRequest struct {
+	TransportId string      `json:"transportId"`
+	Codec       jsonMap     `json:"codec"`
+	Metadata    interface{} `json:"metadata,omitempty"`
+}
+
+type publishResponse struct {
+	SenderId string `json:"senderId"`
+}
+
+type unpublishRequest struct {
+	TransportId string `json:"transportId"`
+	SenderId    string `json:"senderId"`
+}
+
+type subscribeRequest struct {
+	MediaId string `json:"mediaId,omitempty"`
+	//transport of the sender
+	TransportId string `json:"transportId"`
+	SenderId    string `json:"senderId"`
+}
+
+type subscribeResponse struct {
+	Codec      interface{} `json:"codec"`
+	ReceiverId interface{} `json:"receiverId"`
+	SenderId   string      `json:"senderId"`
+}
+
+type unsubscribeRequest struct {
+	TransportId string `json:"transportId"`
+	SenderId    string `json:"senderId"`
+}
+
+// pauseRequest is used by pause and resume
+type pauseRequest struct {
+	TransportId string `json:"transportId"`
+	SenderId    string `json:"senderId"`
+	Role        string `json:"role"`
+}
+
+// messageRequest relays application data to the session or to one tokenId
+type messageRequest struct {
+	To   string          `json:"to,omitempty"`
+	Data json.RawMessage `json:"data"`
+}
+
+// updateMetadataRequest replaces the metadata of the participant,
+// or of one of its senders when senderId is set
+type updateMetadataRequest struct {
+	SenderId string          `json:"senderId,omitempty"`
+	Metadata json.RawMessage `json:"metadata"`
+}
+
+// setAttributesRequest changes session attributes, a null value removes a key,
+// with version the change only succeeds if the attributes are still at that version
+type setAttributesRequest struct {
+	Attributes map[string]interface{} `json:"attributes"`
+	Version    *int64                 `json:"version,omitempty"`
+}
+
+type getAttributesRequest struct{}
+
+// attributesResponse is the response of setAttributes and getAttributes
+type attributesResponse struct {
+	Attributes map[string]interface{} `json:"attributes"`
+	Version    int64                  `json:"version"`
+}
+
+type kickRequest struct {
+	TokenId string `json:"tokenId"`
+	Reason  string `json:"reason,omitempty"`
+	//seconds the tokenId can't join again, 0 means the default
+	Ban int `json:"ban,omitempty"`
+}
+
+type muteRemoteRequest struct {
+	SenderId string `json:"senderId"`
+}
+
+type endSessionRequest struct{}
+
+type emptyResponse struct{}
+
+func (r *helloRequest) validate() error {
+	if r.Version <= 0 {
+		return errors.New("version is required")
+	}
+	return nil
+}
+
+func (r *cancelRequest) validate() error {
+	if len(r.Id) == 0 {
+		return errors.New("id is required")
+	}
+	return nil
+}
+
+func (r *messageRequest) validate() error {
+	if len(r.Data) == 0 {
+		return errors.New("data is required")
+	}
+	if r.To != "" && !subjectToken(r.To) {
+		return errors.New("invalid to")
+	}
+	return nil
+}
+
+// subjectToken reports whether an id can be a token of a NATS subject,
+// wildcards or separators in sessionId, tokenId or to would widen subscriptions
+func subjectToken(id string) bool {
+	return id != "" && !strings.ContainsAny(id, ".*>") && strings.IndexFunc(id, unicode.IsSpace) < 0
+}
+
+func (r *updateMetadataRequest) validate() error {
+	if len(r.Metadata) == 0 {
+		return errors.New("metadata is required")
+	}
+	return nil
+}
+
+func (r *setAttributesRequest) validate() error {
+	if len(r.Attributes) == 0 {
+		return errors.New("attributes are required")
+	}
+	return nil
+}
+
+func (r *getAttributesRequest) validate() error {
+	return nil
+}
+
+func (r *kickRequest) validate() error {
+	if r.TokenId == "" {
+		return errors.New("tokenId is required")
+	}
+	if r.Ban < 0 {
+		return errors.New("ban must not be negative")
+	}
+	return nil
+}
+
+func (r *muteRemoteRequest) validate() error {
+	if r.SenderId == "" {
+		return errors.New("senderId is required")
+	}
+	return nil
+}
+
+func (r *endSessionRequest) validate() error {
+	return nil
+}
+
+func (r *joinRequest) validate() error {
+	return nil
+}
+
+func (r *setAccessRequest) validate() error {
+	return nil
+}
+
+func (r *dtlsRequest) validate() error {
+	if r.TransportId == "" {
+		return errors.New("transportId is required")
+	}
+	if r.DtlsParameters == nil {
+		return errors.New("dtlsParameters is required")
+	}
+	return nil
+}
+
+func (r *publishRequest) kind() string {
+	kind, _ := r.Codec["kind"].(string)
+	return kind
+}
+
+func (r *publishRequest) validate() error {
+	if r.TransportId == "" {
+		return errors.New("transportId is required")
+	}
+	if r.kind() == "" {
+		return errors.New("codec with kind is required")
+	}
+	return nil
+}
+
+func (r *unpublishRequest) validate() error {
+	if r.TransportId == "" || r.SenderId == "" {
+		return errors.New("transportId and senderId are required")
+	}
+	return nil
+}
+
+func (r *subscribeRequest) validate() error {
+	if r.TransportId == "" || r.SenderId == "" {
+		return errors.New("transportId and senderId are required")
+	}
+	return nil
+}
+
+func (r *unsubscribeRequest) validate() error {
+	if r.TransportId == "" || r.SenderId == "" {
+		return errors.New("transportId and senderId are required")
+	}
+	return nil
+}
+
+func (r *pauseRequest) validate() error {
+	if r.TransportId == "" || r.SenderId == "" {
+		return errors.New("transportId and senderId are required")
+	}
+	if r.Role != "pub" && r.Role != "sub" {
+		return errors.New("role must be pub or sub")
+	}
+	return nil
+}
+
+func newRequest(event string) request {
+	switch event {
+	case "hello":
+		return &helloRequest{}
+	case "cancel":
+		return &cancelRequest{}
+	case "join":
+		return &joinRequest{}
+	case "setAccess":
+		return &setAccessRequest{}
+	case "dtls":
+		return &dtlsRequest{}
+	case "publish":
+		return &publishRequest{}
+	case "unpublish":
+		return &unpublishRequest{}
+	case "subscribe":
+		return &subscribeRequest{}
+	case "unsubscribe":
+		return &unsubscribeRequest{}
+	case "pause", "resume":
+		return &pauseRequest{}
+	case "message":
+		return &messageRequest{}
+	case "updateMetadata":
+		return &updateMetadataRequest{}
+	case "setAttributes":
+		return &setAttributesRequest{}
+	case "getAttributes":
+		return &getAttributesRequest{}
+	case "kick":
+		return &kickRequest{}
+	case "muteRemote":
+		return &muteRemoteRequest{}
+	case "endSession":
+		return &endSessionRequest{}
+	}
+	return nil
+}
+
+// decodeRequest turns the data of a client request into its typed request
+func decodeRequest(event string, data json.RawMessage) (request, *signalError) {
+	req := newRequest(event)
+	if req == nil {
+		return nil, errUnknownEvent(event)
+	}
+
+	if len(data) > 0 {
+		err := json.Unmarshal(data, req)
+		if err != nil {
+			return nil, errInvalidParams("invalid %s data : %v", event, err)
+		}
+	}
+
+	err := req.validate()
+	if err != nil {
+		return nil, errInvalidParams("invalid %s data : %v", event, err)
+	}
+	return req, nil
+}
+
+// notifications to clients
+
+type joinNotification struct {
+	TokenId      string            `json:"tokenId"`
+	ConnectionId string            `json:"connectionId"`
+	Metadata     map[string]string `json:"metadata"`
+}
+
+type leaveNotification struct {
+	TokenId      string `json:"tokenId"`
+	ConnectionId string `json:"connectionId"`
+	//the tokenId is still in the session with a newer connection
+	Replaced bool `json:"replaced,omitempty"`
+}
+
+type publishNotification struct {
+	MediaId     string      `json:"mediaId"`
+	Area        string      `json:"area"`
+	Host        string      `json:"host"`
+	TransportId string      `json:"transportId"`
+	SenderId    string      `json:"senderId"`
+	Metadata    interface{} `json:"metadata"`
+	TokenId     string      `json:"tokenId"`
+}
+
+// subscribedNotification is a publish the server already subscribed the client to
+type subscribedNotification struct {
+	Codec      interface{} `json:"codec"`
+	ReceiverId interface{} `json:"receiverId"`
+	SenderId   string      `json:"senderId"`
+	TokenId    string      `json:"tokenId"`
+	Metadata   interface{} `json:"metadata"`
+}
+
+type unpublishNotification struct {
+	SenderId string `json:"senderId"`
+	TokenId  string `json:"tokenId"`
+}
+
+// pauseNotification is used by pause and resume
+type pauseNotification struct {
+	SenderId string `json:"senderId"`
+}
+
+type replacedNotification struct {
+	ConnectionId string `json:"connectionId"`
+}
+
+// metadataChangedNotification carries the new metadata of a participant or of its sender
+type metadataChangedNotification struct {
+	TokenId      string      `json:"tokenId"`
+	ConnectionId string      `json:"connectionId"`
+	SenderId     string      `json:"senderId,omitempty"`
+	Metadata     interface{} `json:"metadata"`
+}
+
+// attributesChangedNotification carries the changed keys, null for removed ones
+type attributesChangedNotification struct {
+	TokenId      string                 `json:"tokenId"`
+	ConnectionId string                 `json:"connectionId"`
+	Attributes   map[string]interface{} `json:"attributes"`
+	Version      int64                  `json:"version"`
+}
+
+// kickedNotification, mutedNotification and sessionEndedNotification name the moderator
+type kickedNotification struct {
+	TokenId string `json:"tokenId"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+type mutedNotification struct {
+	TokenId  string `json:"tokenId"`
+	SenderId string `json:"senderId"`
+}
+
+type sessionEndedNotification struct {
+	TokenId string `json:"tokenId"`
+}
+
+type messageNotification struct {
+	TokenId      string  `json:"tokenId"`
+	ConnectionId string  `json:"connectionId"`
+	Data         rawJSON `json:"data"`
+	//set when the message was sent to this tokenId only
+	Direct bool `json:"direct,omitempty"`
+}
+
+// payloads of natsSubscribedMessage
+
+type joinNotice struct {
+	Metadata map[string]string `json:"metadata"`
+	Pub      bool              `json:"pub"`
+	Sub      bool              `json:"sub"`
+	//the newcomer got a roster, peers don't introduce themselves
+	Roster bool `json:"roster,omitempty"`
+}
+
+type publishNotice struct {
+	MediaId     string      `json:"mediaId"`
+	Area        string      `json:"area"`
+	Host        string      `json:"host"`
+	TransportId string      `json:"transportId"`
+	SenderId    string      `json:"senderId"`
+	Metadata    interface{} `json:"metadata"`
+}
+
+// senderNotice is the payload of unpublish, pause and resume
+type senderNotice struct {
+	SenderId string `json:"senderId"`
+}
+
+// dataNotice is the payload of message
+type dataNotice struct {
+	Data json.RawMessage `json:"data"`
+}
+
+// metadataNotice is the payload of metadataChanged
+type metadataNotice struct {
+	SenderId string      `json:"senderId,omitempty"`
+	Metadata interface{} `json:"metadata"`
+}
+
+// attributesNotice is the payload of attributesChanged
+type attributesNotice struct {
+	Attributes map[string]interface{} `json:"attributes"`
+	Version    int64                  `json:"version"`
+}
+
+// moderationNotice is the payload of kick, mute and endSession
+type moderationNotice struct {
+	SenderId string `json:"senderId,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// leaveNotice is the payload of leave
+type leaveNotice struct {
+	Replaced bool `json:"replaced,omitempty"`
+}
+
+// moderationReply answers kick and mute once the owner of the connection acted
+type moderationReply struct {
+	Error *signalError `json:"error,omitempty"`
+}
+
+type emptyNotice struct{}
+
+// notice is the typed payload of a NATS message between clients
+type notice interface {
+	validate() error
+}
+
+func (n *joinNotice) validate() error {
+	return nil
+}
+
+func (n *publishNotice) validate() error {
+	if n.TransportId == "" || n.SenderId == "" {
+		return errors.New("transportId and senderId are required")
+	}
+	return nil
+}
+
+func (n *senderNotice) validate() error {
+	if n.SenderId == "" {
+		return errors.New("senderId is required")
+	}
+	return nil
+}
+
+func (n *dataNotice) validate() error {
+	if len(n.Data) == 0 {
+		return errors.New("data is required")
+	}
+	return nil
+}
+
+func (n *metadataNotice) validate() error {
+	return nil
+}
+
+func (n *attributesNotice) validate() error {
+	return nil
+}
+
+func (n *moderationNotice) validate() error {
+	return nil
+}
+
+func (n *leaveNotice) validate() error {
+	return nil
+}
+
+func (n *emptyNotice) validate() error {
+	return nil
+}
+
+func newNotice(method string) notice {
+	switch method {
+	case "join":
+		return &joinNotice{}
+	case "publish":
+		return &publishNotice{}
+	case "unpublish", "pause", "resume":
+		return &senderNotice{}
+	case "message":
+		return &dataNotice{}
+	case "metadataChanged":
+		return &metadataNotice{}
+	case "attributesChanged":
+		return &attributesNotice{}
+	case "kick", "mute", "endSession":
+		return &moderationNotice{}
+	case "leave":
+		return &leaveNotice{}
+	}
+	return &emptyNotice{}
+}
+
+// decodeNotice decodes the payload of a NATS message by its method
+func decodeNotice(msg *natsSubscribedMessage) (notice, error) {
+	n := newNotice(msg.Method)
+	if len(msg.Data) > 0 {
+		err := json.Unmarshal(msg.Data, n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return n, n.validate()
+}
@@ -0,0 +1,27 @@
+package libs
+
+import "testing"
+
+func TestSubjectToken(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		ok   bool
+	}{
+		{"plain", "token-1", true},
+		{"empty", "", false},
+		{"separator", "a.b", false},
+		{"wildcard", "*", false},
+		{"full wildcard", ">", false},
+		{"space", "a b", false},
+		{"tab", "a\tb", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := subjectToken(tt.id); got != tt.ok {
+				t.Fatalf("subjectToken(%q) = %v, want %v", tt.id, got, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package libs
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/xeipuuv/gojsonschema"
+	"path/filepath"
+	"strings"
+)
+
+type MetadataConfig struct {
+	MaxKeys        int
+	MaxKeyLength   int
+	MaxValueLength int
+	//size of the json encoded metadata
+	MaxBytes int
+	//optional JSON Schema files
+	ParticipantSchema string
+	SenderSchema      string
+}
+
+// AttributesConfig limits the merged attributes of a session,
+// they are replicated to every instance and sent in every join response
+type AttributesConfig struct {
+	MaxKeys        int
+	MaxKeyLength   int
+	MaxValueLength int
+	MaxBytes       int
+}
+
+type metadataValidator struct {
+	//named in errors
+	kind              string
+	config            MetadataConfig
+	participantSchema *gojsonschema.Schema
+	senderSchema      *gojsonschema.Schema
+}
+
+func loadSchema(path string) (*gojsonschema.Schema, error) {
+	if path == "" {
+		return nil, nil
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	return gojsonschema.NewSchema(gojsonschema.NewReferenceLoader("file://" + filepath.ToSlash(abs)))
+}
+
+func newMetadataValidator(config MetadataConfig) (*metadataValidator, error) {
+	v := &metadataValidator{kind: "metadata", config: config}
+
+	var err error
+	v.participantSchema, err = loadSchema(config.ParticipantSchema)
+	if err != nil {
+		return nil, fmt.Errorf("participant schema : %v", err)
+	}
+	v.senderSchema, err = loadSchema(config.SenderSchema)
+	if err != nil {
+		return nil, fmt.Errorf("sender schema : %v", err)
+	}
+	return v, nil
+}
+
+// validate checks metadata against the limits and schema, limits <= 0 are ignored
+func (v *metadataValidator) validate(metadata interface{}, schema *gojsonschema.Schema) error {
+	//absent metadata must still satisfy required properties of a schema
+	if metadata == nil {
+		metadata = jsonMap{}
+	}
+
+	encoded, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	if v.config.MaxBytes > 0 && len(encoded) > v.config.MaxBytes {
+		return fmt.Errorf("%s exceeds %d bytes", v.kind, v.config.MaxBytes)
+	}
+
+	//limits of keys and values only apply to objects
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(encoded, &fields) == nil {
+		if v.config.MaxKeys > 0 && len(fields) > v.config.MaxKeys {
+			return fmt.Errorf("%s has more than %d keys", v.kind, v.config.MaxKeys)
+		}
+		for key, value := range fields {
+			if v.config.MaxKeyLength > 0 && len(key) > v.config.MaxKeyLength {
+				return fmt.Errorf("%s key exceeds %d bytes", v.kind, v.config.MaxKeyLength)
+			}
+			var s string
+			length := len(value)
+			if json.Unmarshal(value, &s) == nil {
+				length = len(s)
+			}
+			if v.config.MaxValueLength > 0 && length > v.config.MaxValueLength {
+				return fmt.Errorf("%s value of %q exceeds %d bytes", v.kind, key, v.config.MaxValueLength)
+			}
+		}
+	}
+
+	if schema != nil {
+		result, err := schema.Validate(gojsonschema.NewBytesLoader(encoded))
+		if err != nil {
+			return err
+		}
+		if !result.Valid() {
+			var errs []string
+			for _, e := range result.Errors() {
+				errs = append(errs, e.String())
+			}
+			return fmt.Errorf("%s does not match schema : %s", v.kind, strings.Join(errs, "; "))
+		}
+	}
+	return nil
+}
+
+// newAttributesValidator applies the metadata limits to session attributes
+func newAttributesValidator(config AttributesConfig) *metadataValidator {
+	return &metadataValidator{kind: "attributes", config: MetadataConfig{
+		MaxKeys:        config.MaxKeys,
+		MaxKeyLength:   config.MaxKeyLength,
+		MaxValueLength: config.MaxValueLength,
+		MaxBytes:       config.MaxBytes,
+	}}
+}
+
+func (v *metadataValidator) validateParticipant(metadata map[string]string) error {
+	if metadata == nil {
+		return v.validate(nil, v.participantSchema)
+	}
+	return v.validate(metadata, v.participantSchema)
+}
+
+func (v *metadataValidator) validateSender(metadata interface{}) error {
+	return v.validate(metadata, v.senderSchema)
+}
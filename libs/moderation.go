@@ -0,0 +1,148 @@
+package libs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+)
+
+// moderation requests are sent to the connections they target over conn.<connectionId>,
+// the instance owning a connection closes it or talks to its media server
+
+const (
+	//how long a kicked tokenId can't join again unless the kick says otherwise
+	defaultKickBan = 5 * time.Minute
+	//how long nobody can join an ended session again
+	endedSessionBan = 5 * time.Minute
+	//the owner of a muted connection may wait for its media server
+	moderationTimeout = mediaRequestTimeout + time.Second
+)
+
+// request2Connection sends a moderation request to a connection and waits for its outcome
+func (c *client) request2Connection(connectionId string, method string, data notice) *signalError {
+	connSubject := fmt.Sprintf("conn.%s", connectionId)
+
+	var reply moderationReply
+	err := c.clientGroup.nc.Request(connSubject, jsonMap{
+		"tokenId":      c.tokenId,
+		"connectionId": c.connectionId,
+		"method":       method,
+		"data":         data,
+	}, &reply, moderationTimeout)
+	if err == nats.ErrTimeout {
+		return newSignalError(codeMediaTimeout, "connection %s did not answer", connectionId)
+	} else if err != nil {
+		Log.Warnf("Moderation %s of %s failed : %v\n", method, connectionId, err)
+		return newSignalError(codeInternalError, "moderation request failed")
+	}
+	return reply.Error
+}
+
+// kick disconnects every connection of a tokenId and bans it from the session for a while
+func (c *client) kick(req *kickRequest) *signalError {
+	connectionIds := c.clientGroup.sessions.connections(c.sessionId, req.TokenId)
+	if len(connectionIds) == 0 {
+		return newSignalError(codeNotFound, "%s is not in the session", req.TokenId)
+	}
+	ban := defaultKickBan
+	if req.Ban > 0 {
+		ban = time.Duration(req.Ban) * time.Second
+	}
+	Log.Infof("%s kicks %s from session %s for %v\n", c.tokenId, req.TokenId, c.sessionId, ban)
+	//banned first so a reconnect can't slip in
+	c.clientGroup.sessions.ban(c.sessionId, req.TokenId, ban)
+
+	var firstErr *signalError
+	for _, connectionId := range connectionIds {
+		if err := c.request2Connection(connectionId, "kick", &moderationNotice{Reason: req.Reason}); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// muteRemote asks the owner of a sender to pause it
+func (c *client) muteRemote(req *muteRemoteRequest) *signalError {
+	connectionId, ok := c.clientGroup.sessions.senderOwner(c.sessionId, req.SenderId)
+	if !ok {
+		return newSignalError(codeNotFound, "unknown sender %s", req.SenderId)
+	}
+	Log.Infof("%s mutes sender %s in session %s\n", c.tokenId, req.SenderId, c.sessionId)
+	return c.request2Connection(connectionId, "mute", &moderationNotice{SenderId: req.SenderId})
+}
+
+// endSession disconnects every other connection of the session and keeps the session closed
+// for a while, the caller disconnects its own connection once it answered
+func (c *client) endSession() *signalError {
+	Log.Infof("%s ends session %s\n", c.tokenId, c.sessionId)
+	//ended first so a reconnect can't slip in
+	c.clientGroup.sessions.end(c.sessionId, endedSessionBan)
+
+	var mu sync.Mutex
+	var firstErr *signalError
+	var wg sync.WaitGroup
+	for _, connectionId := range c.clientGroup.sessions.sessionConnections(c.sessionId) {
+		if connectionId == c.connectionId {
+			continue
+		}
+		wg.Add(1)
+		go func(connectionId string) {
+			defer wg.Done()
+			if err := c.request2Connection(connectionId, "endSession", &moderationNotice{}); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(connectionId)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// handleModeration acts on a moderation request addressed to this connection,
+// the error is replied to the moderator
+func (c *client) handleModeration(msg *natsSubscribedMessage, moderation *moderationNotice) *signalError {
+	switch msg.Method {
+	case "kick":
+		Log.Infof("%s connection %s kicked by %s\n", c.tokenId, c.connectionId, msg.TokenId)
+		c.notification("kicked", kickedNotification{
+			TokenId: msg.TokenId,
+			Reason:  moderation.Reason,
+		})
+		c.disconnect(websocket.ClosePolicyViolation, "kicked")
+	case "mute":
+		if c.clientGroup.sessions.sender(c, moderation.SenderId) == nil {
+			Log.Warnf("%s has no sender %s to mute\n", c.tokenId, moderation.SenderId)
+			return newSignalError(codeNotFound, "unknown sender %s", moderation.SenderId)
+		}
+		_, err := c.requestMedia(context.Background(), "pause", jsonMap{
+			"transportId": c.pubTransId,
+			"senderId":    moderation.SenderId,
+			"role":        "pub",
+		})
+		if err != nil {
+			Log.Warnf("Mute of %s failed : %v\n", moderation.SenderId, err)
+			return err
+		}
+		c.notification("muted", mutedNotification{
+			TokenId:  msg.TokenId,
+			SenderId: moderation.SenderId,
+		})
+		c.publish2Session("pause", &senderNotice{
+			SenderId: moderation.SenderId,
+		})
+	case "endSession":
+		Log.Infof("%s connection %s closed, session ended by %s\n", c.tokenId, c.connectionId, msg.TokenId)
+		c.notification("sessionEnded", sessionEndedNotification{
+			TokenId: msg.TokenId,
+		})
+		c.disconnect(websocket.CloseNormalClosure, "session ended")
+	}
+	return nil
+}
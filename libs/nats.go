@@ -0,0 +1,57 @@
+package libs
+
+import (
+	"github.com/nats-io/nats.go"
+)
+
+type NatsConfig struct {
+	Urls []string
+	//connection name shown in NATS monitoring
+	Name string
+
+	User     string
+	Password string
+	Token    string
+	//path of the NKey seed file
+	NkeySeed string
+	//path of the .creds file
+	CredsFile string
+
+	TLSCa   string
+	TLSCert string
+	TLSKey  string
+}
+
+func natsOptions(config NatsConfig) ([]nats.Option, error) {
+	var options []nats.Option
+
+	if config.Name != "" {
+		options = append(options, nats.Name(config.Name))
+	}
+
+	if config.User != "" {
+		options = append(options, nats.UserInfo(config.User, config.Password))
+	}
+	if config.Token != "" {
+		options = append(options, nats.Token(config.Token))
+	}
+	if config.NkeySeed != "" {
+		option, err := nats.NkeyOptionFromSeed(config.NkeySeed)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, option)
+	}
+	if config.CredsFile != "" {
+		options = append(options, nats.UserCredentials(config.CredsFile))
+	}
+
+	if config.TLSCa != "" {
+		options = append(options, nats.RootCAs(config.TLSCa))
+	}
+	if config.TLSCert != "" || config.TLSKey != "" {
+		options = append(options, nats.ClientCert(config.TLSCert, config.TLSKey))
+	}
+
+	return options, nil
+}
@@ -0,0 +1,83 @@
+package libs
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+type originPolicy struct {
+	allowAll bool
+	hosts    map[string]bool
+	//suffixes of wildcard entries, `*.example.com` is stored as `.example.com`,
+	//they match the hostname on any port
+	wildcards []string
+	rejected  uint64
+}
+
+func newOriginPolicy(allowedOrigins []string, allowAll bool) *originPolicy {
+	p := &originPolicy{
+		allowAll: allowAll,
+		hosts:    make(map[string]bool),
+	}
+
+	for _, origin := range allowedOrigins {
+		host := strings.ToLower(origin)
+		//entries may be written as full origins
+		if u, err := url.Parse(host); err == nil && u.Host != "" {
+			host = u.Host
+		}
+
+		if strings.HasPrefix(host, "*.") {
+			p.wildcards = append(p.wildcards, host[1:])
+		} else {
+			p.hosts[host] = true
+		}
+	}
+
+	if allowAll {
+		Log.Warn("All origins are allowed, don't use this in production")
+	}
+	return p
+}
+
+func (p *originPolicy) allowed(origin string) bool {
+	if p.allowAll {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host := strings.ToLower(u.Host)
+
+	if p.hosts[host] {
+		return true
+	}
+	hostname := strings.ToLower(u.Hostname())
+	for _, suffix := range p.wildcards {
+		if strings.HasSuffix(hostname, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin is used as websocket.Upgrader.CheckOrigin
+func (p *originPolicy) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	//non-browser clients don't send origin
+	if origin == "" {
+		return true
+	}
+
+	if p.allowed(origin) {
+		return true
+	}
+
+	rejected := atomic.AddUint64(&p.rejected, 1)
+	Log.Warnf("Origin [%s] from %s rejected, %d rejected in total\n", origin, r.RemoteAddr, rejected)
+	return false
+}
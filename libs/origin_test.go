@@ -0,0 +1,48 @@
+package libs
+
+import "testing"
+
+func TestOriginPolicyAllowed(t *testing.T) {
+	policy := newOriginPolicy([]string{
+		"https://app.example.com",
+		"localhost:8080",
+		"*.example.org",
+	}, false)
+
+	tests := []struct {
+		origin string
+		ok     bool
+	}{
+		{"https://app.example.com", true},
+		{"https://APP.example.com", true},
+		{"http://app.example.com", true},
+		{"https://app.example.com:8443", false},
+		{"https://example.com", false},
+		{"https://evil-app.example.com", false},
+		{"http://localhost:8080", true},
+		{"http://localhost", false},
+		{"https://a.example.org", true},
+		{"https://a.b.example.org:8443", true},
+		{"https://example.org", false},
+		{"https://a.example.org.evil.com", false},
+		{"https://evilexample.org", false},
+		{"null", false},
+		{"", false},
+		{"://bad", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			if got := policy.allowed(tt.origin); got != tt.ok {
+				t.Fatalf("allowed(%q) = %v, want %v", tt.origin, got, tt.ok)
+			}
+		})
+	}
+}
+
+func TestOriginPolicyAllowAll(t *testing.T) {
+	policy := &originPolicy{allowAll: true, hosts: map[string]bool{}}
+	if !policy.allowed("https://anything.test") {
+		t.Fatal("allowAll refused an origin")
+	}
+}
@@ -0,0 +1,52 @@
+package libs
+
+type Permissions struct {
+	CanPublish     bool `json:"canPublish"`
+	CanSubscribe   bool `json:"canSubscribe"`
+	CanPublishData bool `json:"canPublishData"`
+	CanModerate    bool `json:"canModerate"`
+	//allowed kinds of published sources (audio, video), empty means all
+	Sources []string `json:"sources"`
+}
+
+func (p *Permissions) allowSource(kind string) bool {
+	if len(p.Sources) == 0 {
+		return true
+	}
+	for _, s := range p.Sources {
+		if s == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// allow checks a client request against the permission set,
+// requests not listed here are denied so a new event has to be added
+func (p *Permissions) allow(req request) bool {
+	switch r := req.(type) {
+	case *helloRequest, *cancelRequest, *dtlsRequest, *getAttributesRequest:
+		return true
+	case *joinRequest:
+		return (!r.Pub || p.CanPublish) && (!r.Sub || p.CanSubscribe)
+	case *publishRequest:
+		return p.CanPublish && p.allowSource(r.kind())
+	case *unpublishRequest:
+		return p.CanPublish
+	case *subscribeRequest, *unsubscribeRequest:
+		return p.CanSubscribe
+	case *pauseRequest:
+		if r.Role == "pub" {
+			return p.CanPublish
+		}
+		return p.CanSubscribe
+	case *setAccessRequest, *setAttributesRequest, *kickRequest, *muteRemoteRequest, *endSessionRequest:
+		return p.CanModerate
+	case *messageRequest:
+		return p.CanPublishData
+	case *updateMetadataRequest:
+		//senders belong to publishers
+		return r.SenderId == "" || p.CanPublish
+	}
+	return false
+}
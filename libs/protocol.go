@@ -0,0 +1,252 @@
+package libs
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// protocols of websocket subprotocols, clients that ask for none speak the native protocol
+const (
+	subprotocolJSONRPC = "jsonrpc-2.0"
+)
+
+// clientMessage is a request of the client or its response to a server request, independent of the protocol
+type clientMessage struct {
+	//raw json id, nil if the client sent none
+	Id    json.RawMessage
+	Event string
+	//params of a request, result of a response
+	Data json.RawMessage
+	//deadline of a request in milliseconds, 0 means none
+	Timeout int
+	//repeats of a key get the original response
+	IdempotencyKey string
+	//response to a server request
+	Response bool
+	Error    *signalError
+}
+
+// protocol is the envelope of messages on a connection, handlers are shared
+type protocol interface {
+	decode(message []byte) (*clientMessage, *signalError)
+	//nil means nothing is sent
+	response(id json.RawMessage, result interface{}) interface{}
+	errorResponse(id json.RawMessage, err *signalError) interface{}
+	notification(event string, data interface{}) interface{}
+	request(id json.RawMessage, event string, data interface{}) interface{}
+}
+
+func newProtocol(name string) protocol {
+	switch name {
+	case subprotocolJSONRPC:
+		return jsonRPCProtocol{}
+	}
+	return nativeProtocol{}
+}
+
+// nativeProtocol:
+//
+//	{"method":"request","id":1,"params":{"event":"join","data":{},"timeout":5000,"idempotencyKey":"k"}}
+//	{"method":"response","id":1,"params":{}}
+//	{"method":"notification","params":{"event":"join","data":{}}}
+//
+// server requests look like client requests and are answered with a response
+type nativeProtocol struct{}
+
+type requestMessage struct {
+	Id     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Error  *signalError    `json:"error"`
+}
+
+type requestMessageParams struct {
+	Event          string          `json:"event"`
+	Data           json.RawMessage `json:"data"`
+	Timeout        int             `json:"timeout"`
+	IdempotencyKey string          `json:"idempotencyKey"`
+}
+
+func (nativeProtocol) decode(message []byte) (*clientMessage, *signalError) {
+	var requestMes requestMessage
+	err := json.Unmarshal(message, &requestMes)
+	if err != nil {
+		return nil, errParse()
+	}
+
+	switch requestMes.Method {
+	case "request":
+	case "response":
+		return &clientMessage{
+			Id:       requestMes.Id,
+			Data:     requestMes.Params,
+			Response: true,
+			Error:    requestMes.Error,
+		}, nil
+	default:
+		return &clientMessage{Id: requestMes.Id}, errInvalidRequest("unknown method %q", requestMes.Method)
+	}
+
+	var params requestMessageParams
+	if len(requestMes.Params) > 0 {
+		err = json.Unmarshal(requestMes.Params, &params)
+		if err != nil {
+			return &clientMessage{Id: requestMes.Id}, errInvalidRequest("invalid params : %v", err)
+		}
+	}
+
+	return &clientMessage{
+		Id:             requestMes.Id,
+		Event:          params.Event,
+		Data:           params.Data,
+		Timeout:        params.Timeout,
+		IdempotencyKey: params.IdempotencyKey,
+	}, nil
+}
+
+func (nativeProtocol) response(id json.RawMessage, result interface{}) interface{} {
+	return jsonMap{
+		"method": "response",
+		"id":     rawJSON(id),
+		"params": result,
+	}
+}
+
+func (nativeProtocol) errorResponse(id json.RawMessage, err *signalError) interface{} {
+	return jsonMap{
+		"method": "response",
+		"id":     rawJSON(id),
+		"error":  err,
+	}
+}
+
+func (nativeProtocol) notification(event string, data interface{}) interface{} {
+	return jsonMap{
+		"method": "notification",
+		"params": jsonMap{
+			"event": event,
+			"data":  data,
+		},
+	}
+}
+
+func (nativeProtocol) request(id json.RawMessage, event string, data interface{}) interface{} {
+	return jsonMap{
+		"method": "request",
+		"id":     rawJSON(id),
+		"params": jsonMap{
+			"event": event,
+			"data":  data,
+		},
+	}
+}
+
+// jsonRPCProtocol follows JSON-RPC 2.0, the event is the method and its data the params,
+// requests without id are notifications and never answered,
+// messages without method are responses to server requests,
+// a request deadline is the extra member "timeout" in milliseconds
+// and an idempotency key the extra member "idempotencyKey",
+// batches are not supported and answered with one invalid request error
+type jsonRPCProtocol struct{}
+
+const jsonRPCVersion = "2.0"
+
+type jsonRPCRequest struct {
+	Version        string          `json:"jsonrpc"`
+	Id             json.RawMessage `json:"id"`
+	Method         string          `json:"method"`
+	Params         json.RawMessage `json:"params"`
+	Result         json.RawMessage `json:"result"`
+	Error          *jsonRPCError   `json:"error"`
+	Timeout        int             `json:"timeout"`
+	IdempotencyKey string          `json:"idempotencyKey"`
+}
+
+type jsonRPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (jsonRPCProtocol) decode(message []byte) (*clientMessage, *signalError) {
+	if trimmed := bytes.TrimLeft(message, " \t\r\n"); len(trimmed) > 0 && trimmed[0] == '[' {
+		return &clientMessage{}, errInvalidRequest("batch requests are not supported")
+	}
+
+	var request jsonRPCRequest
+	err := json.Unmarshal(message, &request)
+	if err != nil {
+		return nil, errParse()
+	}
+
+	if request.Version == jsonRPCVersion && request.Method == "" && (request.Result != nil || request.Error != nil) {
+		response := &clientMessage{
+			Id:       request.Id,
+			Data:     request.Result,
+			Response: true,
+		}
+		if request.Error != nil {
+			response.Error = &signalError{Code: request.Error.Code, Message: request.Error.Message}
+		}
+		return response, nil
+	}
+
+	if request.Version != jsonRPCVersion || request.Method == "" {
+		return &clientMessage{Id: request.Id}, errInvalidRequest("invalid json-rpc request")
+	}
+
+	return &clientMessage{
+		Id:             request.Id,
+		Event:          request.Method,
+		Data:           request.Params,
+		Timeout:        request.Timeout,
+		IdempotencyKey: request.IdempotencyKey,
+	}, nil
+}
+
+func (jsonRPCProtocol) response(id json.RawMessage, result interface{}) interface{} {
+	if id == nil {
+		return nil
+	}
+	return jsonMap{
+		"jsonrpc": jsonRPCVersion,
+		"id":      rawJSON(id),
+		"result":  result,
+	}
+}
+
+func (jsonRPCProtocol) errorResponse(id json.RawMessage, err *signalError) interface{} {
+	//errors of unparsable requests are answered with a null id
+	if id == nil && err.rpcCode != rpcParseError && err.rpcCode != rpcInvalidRequest {
+		return nil
+	}
+
+	code := err.Code
+	if err.rpcCode != 0 {
+		code = err.rpcCode
+	}
+	return jsonMap{
+		"jsonrpc": jsonRPCVersion,
+		"id":      rawJSON(id),
+		"error": jsonRPCError{
+			Code:    code,
+			Message: err.Message,
+		},
+	}
+}
+
+func (jsonRPCProtocol) notification(event string, data interface{}) interface{} {
+	return jsonMap{
+		"jsonrpc": jsonRPCVersion,
+		"method":  event,
+		"params":  data,
+	}
+}
+
+func (jsonRPCProtocol) request(id json.RawMessage, event string, data interface{}) interface{} {
+	return jsonMap{
+		"jsonrpc": jsonRPCVersion,
+		"id":      rawJSON(id),
+		"method":  event,
+		"params":  data,
+	}
+}
@@ -0,0 +1,64 @@
+package libs
+
+import "testing"
+
+func TestJSONRPCDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		//rpc code of the error, 0 means decoded
+		wantRPCCode  int
+		wantId       string
+		wantEvent    string
+		wantData     string
+		wantResponse bool
+		wantTimeout  int
+		wantKey      string
+	}{
+		{"request", `{"jsonrpc":"2.0","id":1,"method":"join","params":{"pub":true},"timeout":5000,"idempotencyKey":"k"}`,
+			0, "1", "join", `{"pub":true}`, false, 5000, "k"},
+		{"notification", `{"jsonrpc":"2.0","method":"message","params":{"data":"hi"}}`,
+			0, "", "message", `{"data":"hi"}`, false, 0, ""},
+		{"response", `{"jsonrpc":"2.0","id":"s1","result":{"ok":true}}`,
+			0, `"s1"`, "", `{"ok":true}`, true, 0, ""},
+		{"error response", `{"jsonrpc":"2.0","id":"s1","error":{"code":403,"message":"refused"}}`,
+			0, `"s1"`, "", "", true, 0, ""},
+		{"batch", ` [{"jsonrpc":"2.0","id":1,"method":"join"}]`,
+			rpcInvalidRequest, "", "", "", false, 0, ""},
+		{"parse error", `{"jsonrpc":`,
+			rpcParseError, "", "", "", false, 0, ""},
+		{"wrong version", `{"jsonrpc":"1.0","id":2,"method":"join"}`,
+			rpcInvalidRequest, "2", "", "", false, 0, ""},
+		{"missing method", `{"jsonrpc":"2.0","id":3,"params":{}}`,
+			rpcInvalidRequest, "3", "", "", false, 0, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := jsonRPCProtocol{}.decode([]byte(tt.message))
+			if tt.wantRPCCode != 0 {
+				if err == nil || err.rpcCode != tt.wantRPCCode {
+					t.Fatalf("error = %v, want rpc code %d", err, tt.wantRPCCode)
+				}
+				//the id is kept so the error can be answered
+				if tt.wantId != "" && (msg == nil || string(msg.Id) != tt.wantId) {
+					t.Fatalf("error message %+v, want id %s", msg, tt.wantId)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decode failed : %v", err)
+			}
+			if string(msg.Id) != tt.wantId || msg.Event != tt.wantEvent || string(msg.Data) != tt.wantData ||
+				msg.Response != tt.wantResponse || msg.Timeout != tt.wantTimeout || msg.IdempotencyKey != tt.wantKey {
+				t.Fatalf("decoded %+v", msg)
+			}
+		})
+	}
+
+	//errors of answers reach the waiting server request
+	msg, _ := jsonRPCProtocol{}.decode([]byte(`{"jsonrpc":"2.0","id":"s1","error":{"code":403,"message":"refused"}}`))
+	if msg.Error == nil || msg.Error.Code != 403 || msg.Error.Message != "refused" {
+		t.Fatalf("error response decoded as %+v", msg.Error)
+	}
+}
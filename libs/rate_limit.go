@@ -0,0 +1,158 @@
+package libs
+
+import (
+	"golang.org/x/time/rate"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	limiterIdleTimeout = 5 * time.Minute
+	//violations are counted per window, a connection limited now and then stays open
+	violationWindow = time.Minute
+)
+
+type Limit struct {
+	//tokens per second
+	Rate  float64
+	Burst int
+}
+
+type RateLimitConfig struct {
+	Enable bool
+	//per ip
+	Upgrade Limit
+	//per connection, for all requests
+	Request Limit
+	//per connection, budgets of single events, event names are case insensitive
+	Events map[string]Limit
+	//per session
+	Broadcast Limit
+	//a connection is closed once it exceeds this many limited requests within violationWindow
+	MaxViolations int
+}
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+type rateLimiter struct {
+	config RateLimitConfig
+
+	mu       sync.Mutex
+	ips      map[string]*limiterEntry
+	sessions map[string]*limiterEntry
+}
+
+func newRateLimiter(config RateLimitConfig) *rateLimiter {
+	return &rateLimiter{
+		config:   config,
+		ips:      make(map[string]*limiterEntry),
+		sessions: make(map[string]*limiterEntry),
+	}
+}
+
+func newLimiter(limit Limit) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(limit.Rate), limit.Burst)
+}
+
+func (l *rateLimiter) allowKey(entries map[string]*limiterEntry, key string, limit Limit) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := entries[key]
+	if !ok {
+		entry = &limiterEntry{limiter: newLimiter(limit)}
+		entries[key] = entry
+	}
+	entry.lastSeen = time.Now()
+	return entry.limiter.Allow()
+}
+
+func (l *rateLimiter) allowUpgrade(r *http.Request) bool {
+	if !l.config.Enable {
+		return true
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return l.allowKey(l.ips, ip, l.config.Upgrade)
+}
+
+func (l *rateLimiter) allowBroadcast(sessionId string) bool {
+	if !l.config.Enable {
+		return true
+	}
+	return l.allowKey(l.sessions, sessionId, l.config.Broadcast)
+}
+
+// sweep drops limiters of idle ips and sessions
+func (l *rateLimiter) sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	deadline := time.Now().Add(-limiterIdleTimeout)
+	for key, entry := range l.ips {
+		if entry.lastSeen.Before(deadline) {
+			delete(l.ips, key)
+		}
+	}
+	for key, entry := range l.sessions {
+		if entry.lastSeen.Before(deadline) {
+			delete(l.sessions, key)
+		}
+	}
+}
+
+// clientLimiter is only used by the read goroutine of its client
+type clientLimiter struct {
+	enable        bool
+	request       *rate.Limiter
+	events        map[string]*rate.Limiter
+	violations    int
+	windowStart   time.Time
+	maxViolations int
+}
+
+func (l *rateLimiter) newClientLimiter() *clientLimiter {
+	cl := &clientLimiter{
+		enable:        l.config.Enable,
+		request:       newLimiter(l.config.Request),
+		events:        make(map[string]*rate.Limiter),
+		maxViolations: l.config.MaxViolations,
+	}
+	//viper lowercases map keys
+	for event, limit := range l.config.Events {
+		cl.events[strings.ToLower(event)] = newLimiter(limit)
+	}
+	return cl
+}
+
+func (cl *clientLimiter) allow(event string) bool {
+	if !cl.enable {
+		return true
+	}
+
+	allowed := cl.request.Allow()
+	if limiter, ok := cl.events[strings.ToLower(event)]; ok && allowed {
+		allowed = limiter.Allow()
+	}
+	if !allowed {
+		now := time.Now()
+		if now.Sub(cl.windowStart) > violationWindow {
+			cl.violations = 0
+			cl.windowStart = now
+		}
+		cl.violations++
+	}
+	return allowed
+}
+
+func (cl *clientLimiter) exceeded() bool {
+	return cl.enable && cl.maxViolations > 0 && cl.violations > cl.maxViolations
+}
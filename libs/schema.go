@@ -0,0 +1,369 @@
+package libs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// responses of client requests by event, the requests come from newRequest
+var requestEvents = map[string]interface{}{
+	"hello":          helloResponse{},
+	"cancel":         emptyResponse{},
+	"join":           joinResponse{},
+	"setAccess":      emptyResponse{},
+	"dtls":           emptyResponse{},
+	"publish":        publishResponse{},
+	"unpublish":      emptyResponse{},
+	"subscribe":      subscribeResponse{},
+	"unsubscribe":    emptyResponse{},
+	"pause":          emptyResponse{},
+	"resume":         emptyResponse{},
+	"message":        emptyResponse{},
+	"updateMetadata": emptyResponse{},
+	"setAttributes":  attributesResponse{},
+	"getAttributes":  attributesResponse{},
+	"kick":           emptyResponse{},
+	"muteRemote":     emptyResponse{},
+	"endSession":     emptyResponse{},
+}
+
+// notifications sent to clients by event, an event may have several shapes
+var notificationEvents = map[string][]interface{}{
+	"join":              {joinNotification{}},
+	"leave":             {leaveNotification{}},
+	"publish":           {publishNotification{}, subscribedNotification{}},
+	"unpublish":         {unpublishNotification{}},
+	"pause":             {pauseNotification{}},
+	"resume":            {pauseNotification{}},
+	"replaced":          {replacedNotification{}},
+	"message":           {messageNotification{}},
+	"metadataChanged":   {metadataChangedNotification{}},
+	"attributesChanged": {attributesChangedNotification{}},
+	"kicked":            {kickedNotification{}},
+	"muted":             {mutedNotification{}},
+	"sessionEnded":      {sessionEndedNotification{}},
+}
+
+var (
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	rawJSONType    = reflect.TypeOf(rawJSON{})
+)
+
+// typeSchema describes how a Go type looks in json,
+// fields without omitempty are required and structs take no unknown fields
+func typeSchema(t reflect.Type) jsonMap {
+	if t == rawMessageType || t == rawJSONType {
+		return jsonMap{}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.Interface:
+		return jsonMap{}
+	case reflect.String:
+		return jsonMap{"type": "string"}
+	case reflect.Bool:
+		return jsonMap{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return jsonMap{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return jsonMap{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return jsonMap{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return jsonMap{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		properties := jsonMap{}
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			tag := strings.Split(field.Tag.Get("json"), ",")
+			name := tag[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = typeSchema(field.Type)
+
+			omitempty := false
+			for _, option := range tag[1:] {
+				if option == "omitempty" {
+					omitempty = true
+				}
+			}
+			if !omitempty {
+				required = append(required, name)
+			}
+		}
+		schema := jsonMap{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+	return jsonMap{}
+}
+
+func valueSchema(v interface{}) jsonMap {
+	return typeSchema(reflect.TypeOf(v))
+}
+
+// schemaRef points to a definition of the protocol schema
+func schemaRef(name string) jsonMap {
+	return jsonMap{"$ref": "#/$defs/" + name}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// envelope is the schema of a frame, the members are closed
+func envelope(properties jsonMap, required ...string) jsonMap {
+	return jsonMap{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+}
+
+// protocolSchema is the document served at /api/schema, a JSON Schema matching every frame of
+// the native protocol and of JSON-RPC. Payloads are $defs named <event>Request, <event>Response
+// and <event>Notification, what the schema can't express is in x- keywords
+func protocolSchema() jsonMap {
+	defs := jsonMap{
+		"error":        valueSchema(signalError{}),
+		"jsonRpcError": valueSchema(jsonRPCError{}),
+		//ids are echoed as sent
+		"id": jsonMap{"type": []string{"string", "number", "null"}},
+		"timeout": jsonMap{
+			"type":        "integer",
+			"minimum":     0,
+			"description": "deadline of the request in milliseconds, an expired request is answered with 504",
+		},
+		"idempotencyKey": jsonMap{
+			"type":        "string",
+			"description": "repeats of the key get the original response, only allowed on publish and subscribe",
+		},
+		"serverRequestData": jsonMap{"description": "data of a server request, sent with the serverRequests capability"},
+	}
+
+	events := sortedKeys(requestEvents)
+	var nativeParams, rpcRequests, results []jsonMap
+	for _, event := range events {
+		defs[event+"Request"] = valueSchema(newRequest(event))
+		defs[event+"Response"] = valueSchema(requestEvents[event])
+
+		nativeParams = append(nativeParams, envelope(jsonMap{
+			"event":          jsonMap{"const": event},
+			"data":           schemaRef(event + "Request"),
+			"timeout":        schemaRef("timeout"),
+			"idempotencyKey": schemaRef("idempotencyKey"),
+		}, "event"))
+		rpcRequests = append(rpcRequests, envelope(jsonMap{
+			"jsonrpc":        jsonMap{"const": jsonRPCVersion},
+			"id":             schemaRef("id"),
+			"method":         jsonMap{"const": event},
+			"params":         schemaRef(event + "Request"),
+			"timeout":        schemaRef("timeout"),
+			"idempotencyKey": schemaRef("idempotencyKey"),
+		}, "jsonrpc", "method"))
+		//several events share a response shape, so a result may match more than one
+		results = append(results, schemaRef(event+"Response"))
+	}
+	cancel := defs["cancelRequest"].(jsonMap)
+	cancel["description"] = "cancels the request with id, which is then answered with 499, media objects created after the cancel are closed again"
+
+	notifications := map[string]interface{}{}
+	for event, shapes := range notificationEvents {
+		notifications[event] = shapes
+	}
+	var nativeNotifications, rpcNotifications []jsonMap
+	for _, event := range sortedKeys(notifications) {
+		shapes := notificationEvents[event]
+		if len(shapes) == 1 {
+			defs[event+"Notification"] = valueSchema(shapes[0])
+		} else {
+			var oneOf []jsonMap
+			for _, shape := range shapes {
+				oneOf = append(oneOf, valueSchema(shape))
+			}
+			defs[event+"Notification"] = jsonMap{"oneOf": oneOf}
+		}
+
+		nativeNotifications = append(nativeNotifications, envelope(jsonMap{
+			"event": jsonMap{"const": event},
+			"data":  schemaRef(event + "Notification"),
+		}, "event", "data"))
+		rpcNotifications = append(rpcNotifications, envelope(jsonMap{
+			"jsonrpc": jsonMap{"const": jsonRPCVersion},
+			"method":  jsonMap{"const": event},
+			"params":  schemaRef(event + "Notification"),
+		}, "jsonrpc", "method", "params"))
+	}
+
+	defs["nativeRequest"] = envelope(jsonMap{
+		"method": jsonMap{"const": "request"},
+		"id":     schemaRef("id"),
+		"params": jsonMap{"oneOf": nativeParams},
+	}, "method", "params")
+	defs["nativeResponse"] = jsonMap{"oneOf": []jsonMap{
+		envelope(jsonMap{
+			"method": jsonMap{"const": "response"},
+			"id":     schemaRef("id"),
+			"params": jsonMap{"anyOf": results},
+		}, "method", "id", "params"),
+		envelope(jsonMap{
+			"method": jsonMap{"const": "response"},
+			"id":     schemaRef("id"),
+			"error":  schemaRef("error"),
+		}, "method", "id", "error"),
+	}}
+	defs["nativeNotification"] = envelope(jsonMap{
+		"method": jsonMap{"const": "notification"},
+		"params": jsonMap{"oneOf": nativeNotifications},
+	}, "method", "params")
+	defs["nativeServerRequest"] = envelope(jsonMap{
+		"method": jsonMap{"const": "request"},
+		"id":     schemaRef("id"),
+		"params": envelope(jsonMap{
+			"event": jsonMap{"type": "string"},
+			"data":  schemaRef("serverRequestData"),
+		}, "event"),
+	}, "method", "id", "params")
+	defs["nativeClientResponse"] = envelope(jsonMap{
+		"method": jsonMap{"const": "response"},
+		"id":     schemaRef("id"),
+		"params": jsonMap{},
+		"error":  schemaRef("error"),
+	}, "method", "id")
+
+	defs["jsonRpcRequest"] = jsonMap{
+		"description": "requests without id are notifications and never answered",
+		"oneOf":       rpcRequests,
+	}
+	defs["jsonRpcResponse"] = jsonMap{"oneOf": []jsonMap{
+		envelope(jsonMap{
+			"jsonrpc": jsonMap{"const": jsonRPCVersion},
+			"id":      schemaRef("id"),
+			"result":  jsonMap{"anyOf": results},
+		}, "jsonrpc", "id", "result"),
+		envelope(jsonMap{
+			"jsonrpc": jsonMap{"const": jsonRPCVersion},
+			"id":      schemaRef("id"),
+			"error":   schemaRef("jsonRpcError"),
+		}, "jsonrpc", "id", "error"),
+	}}
+	defs["jsonRpcNotification"] = jsonMap{"oneOf": rpcNotifications}
+	defs["jsonRpcServerRequest"] = envelope(jsonMap{
+		"jsonrpc": jsonMap{"const": jsonRPCVersion},
+		"id":      schemaRef("id"),
+		"method":  jsonMap{"type": "string"},
+		"params":  schemaRef("serverRequestData"),
+	}, "jsonrpc", "id", "method")
+	defs["jsonRpcClientResponse"] = envelope(jsonMap{
+		"jsonrpc": jsonMap{"const": jsonRPCVersion},
+		"id":      schemaRef("id"),
+		"result":  jsonMap{},
+		"error":   schemaRef("jsonRpcError"),
+	}, "jsonrpc", "id")
+
+	frames := []jsonMap{}
+	for _, name := range []string{
+		"nativeRequest", "nativeResponse", "nativeNotification", "nativeServerRequest", "nativeClientResponse",
+		"jsonRpcRequest", "jsonRpcResponse", "jsonRpcNotification", "jsonRpcServerRequest", "jsonRpcClientResponse",
+	} {
+		frames = append(frames, schemaRef(name))
+	}
+
+	return jsonMap{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"title":       "dugon signaling protocol",
+		"description": "a frame of the native protocol or of " + subprotocolJSONRPC + ", binary subprotocols carry the same values",
+		"anyOf":       frames,
+		"$defs":       defs,
+
+		"x-version":      protocolVersion,
+		"x-minVersion":   minProtocolVersion,
+		"x-capabilities": serverCapabilities,
+		"x-subprotocols": subprotocols,
+	}
+}
+
+// requestValidator checks the data of client requests against their schema, used in development mode
+type requestValidator struct {
+	schemas map[string]*gojsonschema.Schema
+}
+
+func newRequestValidator() (*requestValidator, error) {
+	v := &requestValidator{schemas: map[string]*gojsonschema.Schema{}}
+	for event := range requestEvents {
+		schema, err := gojsonschema.NewSchema(gojsonschema.NewGoLoader(valueSchema(newRequest(event))))
+		if err != nil {
+			return nil, fmt.Errorf("schema of %s : %v", event, err)
+		}
+		v.schemas[event] = schema
+	}
+	return v, nil
+}
+
+func (v *requestValidator) validate(event string, data json.RawMessage) *signalError {
+	schema, ok := v.schemas[event]
+	if !ok {
+		//unknown events are refused by decodeRequest
+		return nil
+	}
+	//missing data decodes like an empty object
+	if len(data) == 0 || string(data) == "null" {
+		data = json.RawMessage("{}")
+	}
+
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(data))
+	if err != nil {
+		return errInvalidParams("invalid %s data : %v", event, err)
+	}
+	if !result.Valid() {
+		var errs []string
+		for _, e := range result.Errors() {
+			errs = append(errs, e.String())
+		}
+		sort.Strings(errs)
+		return errInvalidParams("%s data does not match schema : %s", event, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// schemaHandler serves the protocol schema, it's public like the protocol itself
+type schemaHandler struct {
+	document jsonMap
+}
+
+func (h *schemaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, h.document)
+}
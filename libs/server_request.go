@@ -0,0 +1,65 @@
+package libs
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+const serverRequestTimeout = 10 * time.Second
+
+// clientResponse is the answer of a client to a server request
+type clientResponse struct {
+	result json.RawMessage
+	err    *signalError
+}
+
+// request asks the client to do something and waits for its answer,
+// it blocks so it must not be called from processPump
+func (c *client) request(event string, data interface{}, timeout time.Duration) (json.RawMessage, *signalError) {
+	if !c.hasCapability(capServerRequests) {
+		return nil, newSignalError(codeNotSupported, "client does not support server requests")
+	}
+
+	c.pendingMu.Lock()
+	c.lastRequestId++
+	id := json.RawMessage(strconv.FormatInt(c.lastRequestId, 10))
+	wait := make(chan clientResponse, 1)
+	c.pending[string(id)] = wait
+	c.pendingMu.Unlock()
+
+	defer func() {
+		c.pendingMu.Lock()
+		delete(c.pending, string(id))
+		c.pendingMu.Unlock()
+	}()
+
+	c.write(c.protocol.request(id, event, data))
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case response := <-wait:
+		return response.result, response.err
+	case <-timer.C:
+		return nil, newSignalError(codeRequestTimeout, "client did not answer %s in %v", event, timeout)
+	case <-c.done:
+		return nil, newSignalError(codeClientGone, "client disconnected")
+	}
+}
+
+// resolveRequest hands a client response to the request waiting for it
+func (c *client) resolveRequest(msg *clientMessage) {
+	c.pendingMu.Lock()
+	wait, ok := c.pending[string(msg.Id)]
+	c.pendingMu.Unlock()
+	if !ok {
+		Log.Warnf("%s answered unknown request %s\n", c.tokenId, string(msg.Id))
+		return
+	}
+	//buffered and answered once, a second answer is dropped
+	select {
+	case wait <- clientResponse{result: msg.Data, err: msg.Error}:
+	default:
+	}
+}
@@ -0,0 +1,122 @@
+package libs
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newRequestClient(protocolName string, capable bool) *client {
+	return &client{
+		protocol:  newProtocol(protocolName),
+		send:      make(chan interface{}, 1),
+		done:      make(chan struct{}),
+		pending:   map[string]chan clientResponse{},
+		handshake: handshake{capabilities: map[string]bool{capServerRequests: capable}},
+	}
+}
+
+// sentRequestId returns the id of the server request written to c
+func sentRequestId(t *testing.T, c *client) json.RawMessage {
+	var frame interface{}
+	select {
+	case frame = <-c.send:
+	case <-time.After(time.Second):
+		t.Fatal("no request sent")
+	}
+	encoded, err := json.Marshal(frame)
+	if err != nil {
+		t.Fatalf("request encode error : %v", err)
+	}
+	var sent struct {
+		Id json.RawMessage `json:"id"`
+	}
+	if err := json.Unmarshal(encoded, &sent); err != nil || sent.Id == nil {
+		t.Fatalf("request %s has no id", encoded)
+	}
+	return sent.Id
+}
+
+func TestServerRequest(t *testing.T) {
+	//%s is the id of the server request
+	answers := map[string]struct{ result, failure string }{
+		"native": {
+			`{"method":"response","id":%s,"params":{"confirmed":true}}`,
+			`{"method":"response","id":%s,"error":{"code":403,"message":"refused"}}`,
+		},
+		subprotocolJSONRPC: {
+			`{"jsonrpc":"2.0","id":%s,"result":{"confirmed":true}}`,
+			`{"jsonrpc":"2.0","id":%s,"error":{"code":403,"message":"refused"}}`,
+		},
+	}
+
+	tests := []struct {
+		name    string
+		capable bool
+		//answer sent by the client, empty means none
+		answer     string
+		disconnect bool
+		wantResult string
+		wantCode   int
+	}{
+		{"result", true, "result", false, `{"confirmed":true}`, 0},
+		{"error", true, "failure", false, "", 403},
+		{"timeout", true, "", false, "", codeRequestTimeout},
+		{"client gone", true, "", true, "", codeClientGone},
+		{"not supported", false, "", false, "", codeNotSupported},
+	}
+
+	for protocolName, answer := range answers {
+		for _, tt := range tests {
+			t.Run(protocolName+"/"+tt.name, func(t *testing.T) {
+				c := newRequestClient(protocolName, tt.capable)
+
+				type outcome struct {
+					result json.RawMessage
+					err    *signalError
+				}
+				outcomes := make(chan outcome, 1)
+				go func() {
+					result, err := c.request("confirm", jsonMap{"action": "mute"}, 50*time.Millisecond)
+					outcomes <- outcome{result, err}
+				}()
+
+				if tt.capable {
+					id := sentRequestId(t, c)
+					format := ""
+					switch tt.answer {
+					case "result":
+						format = answer.result
+					case "failure":
+						format = answer.failure
+					}
+					if format != "" {
+						msg, err := c.protocol.decode([]byte(fmt.Sprintf(format, id)))
+						if err != nil || !msg.Response {
+							t.Fatalf("answer decoded as %+v, %v", msg, err)
+						}
+						c.resolveRequest(msg)
+					}
+					if tt.disconnect {
+						close(c.done)
+					}
+				}
+
+				got := <-outcomes
+				if tt.wantCode != 0 {
+					if got.err == nil || got.err.Code != tt.wantCode {
+						t.Fatalf("error = %v, want code %d", got.err, tt.wantCode)
+					}
+				} else if got.err != nil {
+					t.Fatalf("unexpected error %v", got.err)
+				} else if string(got.result) != tt.wantResult {
+					t.Fatalf("result = %s, want %s", got.result, tt.wantResult)
+				}
+				if len(c.pending) != 0 {
+					t.Fatalf("%d requests still pending", len(c.pending))
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package libs
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const sessionAPIPrefix = "/api/sessions/"
+
+type accessRequest struct {
+	Password string   `json:"password"`
+	Invites  []string `json:"invites"`
+}
+
+// sessionHandler serves the admin api of sessions:
+//
+//	PUT    /api/sessions/<sessionId>/access  set password and invites
+//	DELETE /api/sessions/<sessionId>/access  open the session again
+type sessionHandler struct {
+	clientGroup *ClientGroup
+	apiKeys     apiKeys
+}
+
+func (h *sessionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.apiKeys.authorize(w, r); !ok {
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, sessionAPIPrefix), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "access" {
+		http.NotFound(w, r)
+		return
+	}
+	sessionId := parts[0]
+
+	var request accessRequest
+	switch r.Method {
+	case http.MethodPut:
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&request)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := h.clientGroup.sessions.setAccess(sessionId, request.Password, request.Invites)
+	if err != nil {
+		Log.Errorf("Session %s access error : %v\n", sessionId, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	Log.Infof("Session %s access changed by api\n", sessionId)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,685 @@
+package libs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"golang.org/x/crypto/bcrypt"
+	"sync"
+	"time"
+)
+
+const (
+	stateUpdateSubject = "state.update"
+	stateSyncSubject   = "state.sync"
+	stateNodeSubject   = "state.node"
+	//compare and set of attributes on the owner instance, by nodeId
+	stateAttributesSubject   = "state.attributes.%s"
+	attributesRequestTimeout = 2 * time.Second
+	//how long a starting instance collects snapshots of its peers
+	stateSyncWait = time.Second
+	//participants of an instance silent this long are dropped
+	nodeTimeout = 10 * time.Second
+)
+
+// sessionAccess restricts who may join a session, a participant is admitted
+// when its tokenId is invited or it knows the password
+type sessionAccess struct {
+	PasswordHash string   `json:"passwordHash,omitempty"`
+	Invites      []string `json:"invites,omitempty"`
+	//unix nano of the change, the latest one wins between instances
+	Version int64 `json:"version"`
+}
+
+func newSessionAccess(password string, invites []string) (*sessionAccess, error) {
+	access := &sessionAccess{
+		Invites: invites,
+		Version: time.Now().UnixNano(),
+	}
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		access.PasswordHash = string(hash)
+	}
+	return access, nil
+}
+
+func (a *sessionAccess) restricted() bool {
+	return a != nil && (a.PasswordHash != "" || len(a.Invites) > 0)
+}
+
+func (a *sessionAccess) admit(tokenId string, password string) bool {
+	if !a.restricted() {
+		return true
+	}
+	for _, invite := range a.Invites {
+		if invite == tokenId {
+			return true
+		}
+	}
+	if a.PasswordHash != "" && password != "" {
+		return bcrypt.CompareHashAndPassword([]byte(a.PasswordHash), []byte(password)) == nil
+	}
+	return false
+}
+
+// participantState is one connection of a tokenId, owned by the instance NodeId,
+// only the owner changes it so a whole copy is broadcast on every change
+type participantState struct {
+	TokenId      string            `json:"tokenId"`
+	ConnectionId string            `json:"connectionId"`
+	NodeId       string            `json:"nodeId"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	//set by the join request, connections that never joined are not in the roster
+	Joined bool `json:"joined,omitempty"`
+	Pub    bool `json:"pub,omitempty"`
+	Sub    bool `json:"sub,omitempty"`
+	//by senderId
+	Senders map[string]*publishNotification `json:"senders,omitempty"`
+	//unix nano of the change, late echoes of older copies are ignored
+	Version int64 `json:"version"`
+}
+
+func (p *participantState) clone() *participantState {
+	copied := *p
+	copied.Senders = make(map[string]*publishNotification, len(p.Senders))
+	for senderId, sender := range p.Senders {
+		copied.Senders[senderId] = sender
+	}
+	return &copied
+}
+
+// sessionAttributes is the shared key/value state of a session, every change bumps Version.
+// Changes are compared and set on the owner instance of the session, only while instances
+// disagree on the owner two changes can get the same version, then the higher NodeId wins
+type sessionAttributes struct {
+	Values  map[string]interface{} `json:"values"`
+	Version int64                  `json:"version"`
+	NodeId  string                 `json:"nodeId"`
+}
+
+func (a *sessionAttributes) newer(than *sessionAttributes) bool {
+	if than == nil {
+		return true
+	}
+	if a.Version != than.Version {
+		return a.Version > than.Version
+	}
+	return a.NodeId > than.NodeId
+}
+
+type sessionState struct {
+	Access     *sessionAccess     `json:"access,omitempty"`
+	Attributes *sessionAttributes `json:"attributes,omitempty"`
+	//by connectionId
+	Participants map[string]*participantState `json:"participants,omitempty"`
+	//unix nano until a kicked tokenId may join again, by tokenId
+	Bans map[string]int64 `json:"bans,omitempty"`
+	//unix nano until nobody may join an ended session again
+	Ended int64 `json:"ended,omitempty"`
+}
+
+// sessionBan keeps a kicked tokenId out of a session
+type sessionBan struct {
+	TokenId string `json:"tokenId"`
+	Until   int64  `json:"until"`
+}
+
+type stateUpdate struct {
+	SessionId  string             `json:"sessionId"`
+	Access     *sessionAccess     `json:"access,omitempty"`
+	Attributes *sessionAttributes `json:"attributes,omitempty"`
+	//adds or replaces a participant
+	Join *participantState `json:"join,omitempty"`
+	//connectionId
+	Leave string      `json:"leave,omitempty"`
+	Ban   *sessionBan `json:"ban,omitempty"`
+	//unix nano until the session stays ended
+	Ended int64 `json:"ended,omitempty"`
+}
+
+// attributesRequest asks the owner instance of a session to compare and set its attributes
+type attributesRequest struct {
+	SessionId string                 `json:"sessionId"`
+	Changes   map[string]interface{} `json:"changes"`
+	Expected  *int64                 `json:"expected,omitempty"`
+}
+
+type attributesReply struct {
+	Attributes *sessionAttributes `json:"attributes,omitempty"`
+	Error      *signalError       `json:"error,omitempty"`
+}
+
+type nodeHeartbeat struct {
+	NodeId string `json:"nodeId"`
+}
+
+// sessionStore keeps session state replicated between signal instances,
+// changes are broadcast over NATS and a starting instance syncs from its peers
+type sessionStore struct {
+	nc     *nats.EncodedConn
+	nodeId string
+	//limits of merged attributes
+	limits *metadataValidator
+
+	mu       sync.RWMutex
+	sessions map[string]*sessionState
+	//last heartbeat of every instance
+	nodes map[string]time.Time
+}
+
+func newSessionStore(nc *nats.EncodedConn, nodeId string, limits *metadataValidator) *sessionStore {
+	s := &sessionStore{
+		nc:       nc,
+		nodeId:   nodeId,
+		limits:   limits,
+		sessions: make(map[string]*sessionState),
+		nodes:    make(map[string]time.Time),
+	}
+
+	s.nc.Subscribe(stateUpdateSubject, func(update *stateUpdate) {
+		s.apply(update)
+	})
+
+	s.nc.Subscribe(stateNodeSubject, func(heartbeat *nodeHeartbeat) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.nodes[heartbeat.NodeId] = time.Now()
+	})
+
+	s.nc.Subscribe(fmt.Sprintf(stateAttributesSubject, nodeId), func(subject, reply string, req *attributesRequest) {
+		update, err := s.casAttributes(req.SessionId, req.Changes, req.Expected)
+		if err != nil {
+			s.nc.Publish(reply, &attributesReply{Error: err})
+			return
+		}
+		s.broadcast(update)
+		s.nc.Publish(reply, &attributesReply{Attributes: update.Attributes})
+	})
+
+	s.sync()
+
+	s.nc.Subscribe(stateSyncSubject, func(subject, reply string, _ jsonMap) {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		s.nc.Publish(reply, s.sessions)
+	})
+
+	return s
+}
+
+// sync collects the state of running instances
+func (s *sessionStore) sync() {
+	inbox := nats.NewInbox()
+	sub, err := s.nc.Conn.SubscribeSync(inbox)
+	if err != nil {
+		Log.Warnf("State sync subscribe error : %v\n", err)
+		return
+	}
+	defer sub.Unsubscribe()
+
+	err = s.nc.PublishRequest(stateSyncSubject, inbox, jsonMap{})
+	if err != nil {
+		Log.Warnf("State sync request error : %v\n", err)
+		return
+	}
+
+	deadline := time.Now().Add(stateSyncWait)
+	for {
+		msg, err := sub.NextMsg(time.Until(deadline))
+		if err != nil {
+			break
+		}
+		var snapshot map[string]*sessionState
+		err = json.Unmarshal(msg.Data, &snapshot)
+		if err != nil {
+			Log.Warnf("State snapshot json decode error : %v\n", err)
+			continue
+		}
+		for sessionId, state := range snapshot {
+			s.apply(&stateUpdate{SessionId: sessionId, Access: state.Access, Attributes: state.Attributes, Ended: state.Ended})
+			for _, participant := range state.Participants {
+				s.apply(&stateUpdate{SessionId: sessionId, Join: participant})
+			}
+			for tokenId, until := range state.Bans {
+				s.apply(&stateUpdate{SessionId: sessionId, Ban: &sessionBan{TokenId: tokenId, Until: until}})
+			}
+		}
+	}
+	s.mu.RLock()
+	Log.Infof("State synced, %d sessions\n", len(s.sessions))
+	s.mu.RUnlock()
+}
+
+func (s *sessionStore) apply(update *stateUpdate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.applyLocked(update)
+}
+
+// applyLocked is apply for callers holding mu
+func (s *sessionStore) applyLocked(update *stateUpdate) {
+	state, ok := s.sessions[update.SessionId]
+	if !ok {
+		state = &sessionState{Participants: make(map[string]*participantState)}
+		s.sessions[update.SessionId] = state
+	}
+
+	if update.Access != nil && (state.Access == nil || update.Access.Version > state.Access.Version) {
+		state.Access = update.Access
+	}
+	if update.Attributes != nil && update.Attributes.newer(state.Attributes) {
+		state.Attributes = update.Attributes
+	}
+
+	if update.Join != nil {
+		if current, ok := state.Participants[update.Join.ConnectionId]; !ok || update.Join.Version >= current.Version {
+			state.Participants[update.Join.ConnectionId] = update.Join
+		}
+		if _, ok := s.nodes[update.Join.NodeId]; !ok {
+			s.nodes[update.Join.NodeId] = time.Now()
+		}
+	}
+	if update.Leave != "" {
+		delete(state.Participants, update.Leave)
+	}
+	if update.Ban != nil && update.Ban.Until > state.Bans[update.Ban.TokenId] {
+		if state.Bans == nil {
+			state.Bans = make(map[string]int64)
+		}
+		state.Bans[update.Ban.TokenId] = update.Ban.Until
+	}
+	if update.Ended > state.Ended {
+		state.Ended = update.Ended
+	}
+
+	s.dropIfEmpty(update.SessionId, state)
+}
+
+// dropIfEmpty forgets sessions without participants, access, bans and end, must hold mu
+func (s *sessionStore) dropIfEmpty(sessionId string, state *sessionState) {
+	if len(state.Participants) == 0 && !state.Access.restricted() && len(state.Bans) == 0 && state.Ended == 0 {
+		delete(s.sessions, sessionId)
+	}
+}
+
+// heartbeat announces this instance and drops participants of silent ones,
+// called periodically by ClientGroup.Run
+func (s *sessionStore) heartbeat() {
+	s.nc.Publish(stateNodeSubject, &nodeHeartbeat{NodeId: s.nodeId})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.nodes[s.nodeId] = now
+	for sessionId, state := range s.sessions {
+		for tokenId, until := range state.Bans {
+			if until <= now.UnixNano() {
+				delete(state.Bans, tokenId)
+			}
+		}
+		if state.Ended <= now.UnixNano() {
+			state.Ended = 0
+		}
+		s.dropIfEmpty(sessionId, state)
+	}
+	for nodeId, lastSeen := range s.nodes {
+		if now.Sub(lastSeen) < nodeTimeout {
+			continue
+		}
+		Log.Warnf("Signal node %s died\n", nodeId)
+		delete(s.nodes, nodeId)
+		for sessionId, state := range s.sessions {
+			for connectionId, participant := range state.Participants {
+				if participant.NodeId == nodeId {
+					delete(state.Participants, connectionId)
+				}
+			}
+			s.dropIfEmpty(sessionId, state)
+		}
+	}
+}
+
+func (s *sessionStore) publish(update *stateUpdate) {
+	s.apply(update)
+	s.broadcast(update)
+}
+
+// broadcast sends an update already applied here to the other instances
+func (s *sessionStore) broadcast(update *stateUpdate) {
+	err := s.nc.Publish(stateUpdateSubject, update)
+	if err != nil {
+		Log.Warnf("State update publish error : %v\n", err)
+	}
+}
+
+// admit checks a tokenId against the end, bans and access of a session
+func (s *sessionStore) admit(sessionId string, tokenId string, password string) bool {
+	s.mu.RLock()
+	var access *sessionAccess
+	var bannedUntil, endedUntil int64
+	if state, ok := s.sessions[sessionId]; ok {
+		access = state.Access
+		bannedUntil = state.Bans[tokenId]
+		endedUntil = state.Ended
+	}
+	s.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	if bannedUntil > now || endedUntil > now {
+		return false
+	}
+	//the password hash is compared without holding mu
+	return access.admit(tokenId, password)
+}
+
+// ban keeps tokenId out of a session for d
+func (s *sessionStore) ban(sessionId string, tokenId string, d time.Duration) {
+	s.publish(&stateUpdate{SessionId: sessionId, Ban: &sessionBan{TokenId: tokenId, Until: time.Now().Add(d).UnixNano()}})
+}
+
+// end keeps everyone out of a session for d
+func (s *sessionStore) end(sessionId string, d time.Duration) {
+	s.publish(&stateUpdate{SessionId: sessionId, Ended: time.Now().Add(d).UnixNano()})
+}
+
+func (s *sessionStore) join(c *client) {
+	s.publish(&stateUpdate{
+		SessionId: c.sessionId,
+		Join: &participantState{
+			TokenId:      c.tokenId,
+			ConnectionId: c.connectionId,
+			NodeId:       s.nodeId,
+			Metadata:     c.currentMetadata(),
+			Version:      time.Now().UnixNano(),
+		},
+	})
+}
+
+// updateParticipant broadcasts a changed copy of the participant of c,
+// the copy is changed and applied under mu so concurrent changes build on each other
+func (s *sessionStore) updateParticipant(c *client, change func(p *participantState)) {
+	s.mu.Lock()
+	var participant *participantState
+	if state, ok := s.sessions[c.sessionId]; ok {
+		if p, ok := state.Participants[c.connectionId]; ok {
+			participant = p.clone()
+		}
+	}
+	if participant == nil {
+		s.mu.Unlock()
+		Log.Warnf("%s connection %s is not in session %s\n", c.tokenId, c.connectionId, c.sessionId)
+		return
+	}
+
+	change(participant)
+	//newer than the current copy even if the clock didn't move
+	version := time.Now().UnixNano()
+	if version <= participant.Version {
+		version = participant.Version + 1
+	}
+	participant.Version = version
+	update := &stateUpdate{SessionId: c.sessionId, Join: participant}
+	s.applyLocked(update)
+	s.mu.Unlock()
+	s.broadcast(update)
+}
+
+// joined marks the participant of c as part of the roster
+func (s *sessionStore) joined(c *client) {
+	s.updateParticipant(c, func(p *participantState) {
+		p.Joined = true
+		p.Pub, p.Sub = c.joinedAs()
+	})
+}
+
+func (s *sessionStore) addSender(c *client, sender *publishNotification) {
+	s.updateParticipant(c, func(p *participantState) {
+		p.Senders[sender.SenderId] = sender
+	})
+}
+
+func (s *sessionStore) removeSender(c *client, senderId string) {
+	s.updateParticipant(c, func(p *participantState) {
+		delete(p.Senders, senderId)
+	})
+}
+
+// sender returns a sender published by c, nil if there is none
+func (s *sessionStore) sender(c *client, senderId string) *publishNotification {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if state, ok := s.sessions[c.sessionId]; ok {
+		if participant, ok := state.Participants[c.connectionId]; ok {
+			return participant.Senders[senderId]
+		}
+	}
+	return nil
+}
+
+// senders returns the senders published by c with their current metadata
+func (s *sessionStore) senders(c *client) []*publishNotification {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var senders []*publishNotification
+	if state, ok := s.sessions[c.sessionId]; ok {
+		if participant, ok := state.Participants[c.connectionId]; ok {
+			for _, sender := range participant.Senders {
+				senders = append(senders, sender)
+			}
+		}
+	}
+	return senders
+}
+
+func (s *sessionStore) setMetadata(c *client, metadata map[string]string) {
+	s.updateParticipant(c, func(p *participantState) {
+		p.Metadata = metadata
+	})
+}
+
+func (s *sessionStore) setSenderMetadata(c *client, senderId string, metadata interface{}) {
+	s.updateParticipant(c, func(p *participantState) {
+		if sender, ok := p.Senders[senderId]; ok {
+			//senders are shared with older copies
+			changed := *sender
+			changed.Metadata = metadata
+			p.Senders[senderId] = &changed
+		}
+	})
+}
+
+// attributes returns the attributes of a session and their version
+func (s *sessionStore) attributes(sessionId string) (map[string]interface{}, int64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if state, ok := s.sessions[sessionId]; ok && state.Attributes != nil {
+		return state.Attributes.Values, state.Attributes.Version
+	}
+	return map[string]interface{}{}, 0
+}
+
+// setAttributes merges changes into the attributes of a session, a nil value removes its key.
+// With an expected version the change is refused unless it's the current one.
+// The owner instance of the session compares and sets, others ask it over NATS
+func (s *sessionStore) setAttributes(sessionId string, changes map[string]interface{}, expected *int64) (*sessionAttributes, *signalError) {
+	owner := s.attributesOwner(sessionId)
+	if owner == s.nodeId {
+		update, err := s.casAttributes(sessionId, changes, expected)
+		if err != nil {
+			return nil, err
+		}
+		s.broadcast(update)
+		return update.Attributes, nil
+	}
+
+	var reply attributesReply
+	subject := fmt.Sprintf(stateAttributesSubject, owner)
+	err := s.nc.Request(subject, &attributesRequest{SessionId: sessionId, Changes: changes, Expected: expected}, &reply, attributesRequestTimeout)
+	if err != nil {
+		Log.Warnf("Attributes of %s on %s failed : %v\n", sessionId, owner, err)
+		return nil, newSignalError(codeInternalError, "attributes owner unavailable")
+	}
+	if reply.Error != nil {
+		return nil, reply.Error
+	}
+	//visible here before the broadcast of the owner arrives
+	s.apply(&stateUpdate{SessionId: sessionId, Attributes: reply.Attributes})
+	return reply.Attributes, nil
+}
+
+// casAttributes compares and sets the attributes of a session here, the returned
+// update is applied but not yet broadcast
+func (s *sessionStore) casAttributes(sessionId string, changes map[string]interface{}, expected *int64) (*stateUpdate, *signalError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := &sessionAttributes{Values: map[string]interface{}{}}
+	if state, ok := s.sessions[sessionId]; ok && state.Attributes != nil {
+		current = state.Attributes
+	}
+	if expected != nil && *expected != current.Version {
+		return nil, newSignalError(codeConflict, "attributes version is %d", current.Version)
+	}
+
+	attributes := &sessionAttributes{
+		Values:  make(map[string]interface{}, len(current.Values)+len(changes)),
+		Version: current.Version + 1,
+		NodeId:  s.nodeId,
+	}
+	for key, value := range current.Values {
+		attributes.Values[key] = value
+	}
+	for key, value := range changes {
+		if value == nil {
+			delete(attributes.Values, key)
+		} else {
+			attributes.Values[key] = value
+		}
+	}
+	if s.limits != nil {
+		if err := s.limits.validate(attributes.Values, nil); err != nil {
+			return nil, newSignalError(codeBadRequest, "%v", err)
+		}
+	}
+	//applied before unlocking so a concurrent change sees the new version
+	update := &stateUpdate{SessionId: sessionId, Attributes: attributes}
+	s.applyLocked(update)
+	return update, nil
+}
+
+// attributesOwner picks the instance that compares and sets the attributes of a session,
+// a rendezvous hash over the live instances that all of them agree on while none joins or dies
+func (s *sessionStore) attributesOwner(sessionId string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	owner, best := s.nodeId, rendezvousHash(s.nodeId, sessionId)
+	for nodeId := range s.nodes {
+		if h := rendezvousHash(nodeId, sessionId); h > best || (h == best && nodeId > owner) {
+			owner, best = nodeId, h
+		}
+	}
+	return owner
+}
+
+// rendezvousHash needs every bit mixed, fnv barely changes the high bits for a different sessionId
+func rendezvousHash(nodeId string, sessionId string) uint64 {
+	sum := sha256.Sum256([]byte(nodeId + "\x00" + sessionId))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// senderOwner returns the connection that published a sender
+func (s *sessionStore) senderOwner(sessionId string, senderId string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if state, ok := s.sessions[sessionId]; ok {
+		for connectionId, participant := range state.Participants {
+			if _, ok := participant.Senders[senderId]; ok {
+				return connectionId, true
+			}
+		}
+	}
+	return "", false
+}
+
+// sessionConnections returns the connectionIds of a session, joined or not
+func (s *sessionStore) sessionConnections(sessionId string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var connectionIds []string
+	if state, ok := s.sessions[sessionId]; ok {
+		for connectionId := range state.Participants {
+			connectionIds = append(connectionIds, connectionId)
+		}
+	}
+	return connectionIds
+}
+
+// roster is a snapshot of the joined participants of a session but one connection
+func (s *sessionStore) roster(sessionId string, exceptConnectionId string) []rosterParticipant {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	roster := []rosterParticipant{}
+	state, ok := s.sessions[sessionId]
+	if !ok {
+		return roster
+	}
+	for connectionId, participant := range state.Participants {
+		if connectionId == exceptConnectionId || !participant.Joined {
+			continue
+		}
+		senders := []*publishNotification{}
+		for _, sender := range participant.Senders {
+			senders = append(senders, sender)
+		}
+		roster = append(roster, rosterParticipant{
+			TokenId:      participant.TokenId,
+			ConnectionId: connectionId,
+			Metadata:     participant.Metadata,
+			Senders:      senders,
+		})
+	}
+	return roster
+}
+
+func (s *sessionStore) leave(c *client) {
+	s.publish(&stateUpdate{SessionId: c.sessionId, Leave: c.connectionId})
+}
+
+// connections returns the connectionIds of tokenId in a session
+func (s *sessionStore) connections(sessionId string, tokenId string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var connectionIds []string
+	if state, ok := s.sessions[sessionId]; ok {
+		for connectionId, participant := range state.Participants {
+			if participant.TokenId == tokenId {
+				connectionIds = append(connectionIds, connectionId)
+			}
+		}
+	}
+	return connectionIds
+}
+
+// setAccess replaces the access of a session, empty password and invites open it again
+func (s *sessionStore) setAccess(sessionId string, password string, invites []string) error {
+	access, err := newSessionAccess(password, invites)
+	if err != nil {
+		return err
+	}
+	s.publish(&stateUpdate{SessionId: sessionId, Access: access})
+	return nil
+}
@@ -0,0 +1,118 @@
+package libs
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestStore(nodeId string) *sessionStore {
+	return &sessionStore{
+		nodeId:   nodeId,
+		limits:   newAttributesValidator(AttributesConfig{MaxKeys: 3}),
+		sessions: make(map[string]*sessionState),
+		nodes:    make(map[string]time.Time),
+	}
+}
+
+func version(v int64) *int64 {
+	return &v
+}
+
+func TestCasAttributes(t *testing.T) {
+	s := newTestStore("node")
+	//sessions without participants are dropped
+	s.apply(&stateUpdate{SessionId: "session", Join: &participantState{TokenId: "token", ConnectionId: "conn", NodeId: "node"}})
+
+	//the steps run in order on one session
+	tests := []struct {
+		name        string
+		changes     map[string]interface{}
+		expected    *int64
+		wantCode    int
+		wantVersion int64
+		wantValues  map[string]interface{}
+	}{
+		{"first set", map[string]interface{}{"a": "1"}, nil, 0, 1, map[string]interface{}{"a": "1"}},
+		{"expected current version", map[string]interface{}{"b": "2"}, version(1), 0, 2, map[string]interface{}{"a": "1", "b": "2"}},
+		{"stale version", map[string]interface{}{"a": "x"}, version(1), codeConflict, 2, map[string]interface{}{"a": "1", "b": "2"}},
+		{"nil removes", map[string]interface{}{"a": nil}, version(2), 0, 3, map[string]interface{}{"b": "2"}},
+		{"over the key limit", map[string]interface{}{"c": "3", "d": "4", "e": "5"}, nil, codeBadRequest, 3, map[string]interface{}{"b": "2"}},
+		{"unconditional", map[string]interface{}{"c": "3"}, nil, 0, 4, map[string]interface{}{"b": "2", "c": "3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			update, err := s.casAttributes("session", tt.changes, tt.expected)
+			if tt.wantCode != 0 {
+				if err == nil || err.Code != tt.wantCode {
+					t.Fatalf("error = %v, want code %d", err, tt.wantCode)
+				}
+			} else if err != nil {
+				t.Fatalf("casAttributes failed : %v", err)
+			} else if update.Attributes.Version != tt.wantVersion || update.Attributes.NodeId != "node" {
+				t.Fatalf("update %+v, want version %d", update.Attributes, tt.wantVersion)
+			}
+
+			values, version := s.attributes("session")
+			if version != tt.wantVersion || len(values) != len(tt.wantValues) {
+				t.Fatalf("attributes %v at %d, want %v at %d", values, version, tt.wantValues, tt.wantVersion)
+			}
+			for key, value := range tt.wantValues {
+				if values[key] != value {
+					t.Fatalf("attributes %v, want %v", values, tt.wantValues)
+				}
+			}
+		})
+	}
+}
+
+func TestAttributesOwner(t *testing.T) {
+	nodes := []string{"node-a", "node-b", "node-c"}
+	stores := make([]*sessionStore, len(nodes))
+	for i, nodeId := range nodes {
+		stores[i] = newTestStore(nodeId)
+		for _, peer := range nodes {
+			stores[i].nodes[peer] = time.Now()
+		}
+	}
+
+	owners := map[string]bool{}
+	for _, sessionId := range []string{"s1", "s2", "s3", "s4", "s5", "s6", "s7", "s8"} {
+		owner := stores[0].attributesOwner(sessionId)
+		owners[owner] = true
+		for _, s := range stores[1:] {
+			if got := s.attributesOwner(sessionId); got != owner {
+				t.Fatalf("%s owns %s on %s but %s on %s", owner, sessionId, stores[0].nodeId, got, s.nodeId)
+			}
+		}
+	}
+	if len(owners) < 2 {
+		t.Fatalf("all sessions are owned by %v", owners)
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		update stateUpdate
+		ok     bool
+	}{
+		{"unknown session", stateUpdate{SessionId: "other"}, true},
+		{"banned", stateUpdate{SessionId: "session", Ban: &sessionBan{TokenId: "token", Until: now.Add(time.Minute).UnixNano()}}, false},
+		{"other token banned", stateUpdate{SessionId: "session", Ban: &sessionBan{TokenId: "other", Until: now.Add(time.Minute).UnixNano()}}, true},
+		{"ban expired", stateUpdate{SessionId: "session", Ban: &sessionBan{TokenId: "token", Until: now.Add(-time.Minute).UnixNano()}}, true},
+		{"ended", stateUpdate{SessionId: "session", Ended: now.Add(time.Minute).UnixNano()}, false},
+		{"end expired", stateUpdate{SessionId: "session", Ended: now.Add(-time.Minute).UnixNano()}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore("node")
+			s.apply(&tt.update)
+			if got := s.admit("session", "token", ""); got != tt.ok {
+				t.Fatalf("admit = %v, want %v", got, tt.ok)
+			}
+		})
+	}
+}
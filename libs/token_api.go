@@ -0,0 +1,95 @@
+package libs
+
+import (
+	"encoding/json"
+	"github.com/golang-jwt/jwt"
+	"net/http"
+	"time"
+)
+
+type TokenAPIConfig struct {
+	//lifetime of tokens requested without ttl
+	DefaultTTL time.Duration
+	MaxTTL     time.Duration
+}
+
+type tokenRequest struct {
+	SessionId   string            `json:"sessionId"`
+	TokenId     string            `json:"tokenId"`
+	Metadata    map[string]string `json:"metadata"`
+	Permissions *Permissions      `json:"permissions"`
+	//seconds
+	TTL int64 `json:"ttl"`
+}
+
+type tokenResponse struct {
+	Token     string `json:"token"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// tokenHandler serves POST /api/tokens for application servers,
+// requests are authenticated by basic auth with an api key/secret pair
+type tokenHandler struct {
+	auth    *Authenticator
+	apiKeys apiKeys
+	config  TokenAPIConfig
+}
+
+func newTokenHandler(auth *Authenticator, apiKeys apiKeys, config TokenAPIConfig) *tokenHandler {
+	return &tokenHandler{
+		auth:    auth,
+		apiKeys: apiKeys,
+		config:  config,
+	}
+}
+
+func (h *tokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	apiKey, ok := h.apiKeys.authorize(w, r)
+	if !ok {
+		return
+	}
+
+	var request tokenRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&request)
+	if err != nil || !subjectToken(request.SessionId) || !subjectToken(request.TokenId) {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	ttl := h.config.DefaultTTL
+	if request.TTL > 0 {
+		ttl = time.Duration(request.TTL) * time.Second
+	}
+	if ttl > h.config.MaxTTL {
+		ttl = h.config.MaxTTL
+	}
+
+	now := time.Now()
+	claims := &joinClaims{
+		SessionId:   request.SessionId,
+		TokenId:     request.TokenId,
+		Metadata:    request.Metadata,
+		Permissions: request.Permissions,
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    apiKey,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(ttl).Unix(),
+		},
+	}
+
+	token, err := h.auth.issue(claims)
+	if err != nil {
+		Log.Errorf("Token sign error : %v\n", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	Log.Debugf("Token issued by %s for %s@%s\n", apiKey, request.TokenId, request.SessionId)
+	writeJSON(w, http.StatusOK, tokenResponse{Token: token, ExpiresAt: claims.ExpiresAt})
+}
@@ -4,10 +4,50 @@ import (
 	"github.com/0-u-0/dugon-signal-server/libs"
 	"github.com/spf13/viper"
 	"log"
+	"time"
 )
 
 var lastCompile string
 
+// settings never written to the log, matched by key at any depth
+var secretSettings = map[string]bool{
+	"secret":      true,
+	"private_key": true,
+	"password":    true,
+	"token":       true,
+	"nkey_seed":   true,
+}
+
+// redacted copies settings with the values of secretSettings masked, empty values stay empty
+func redacted(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			if secretSettings[key] && item != "" {
+				copied[key] = "******"
+			} else {
+				copied[key] = redacted(item)
+			}
+		}
+		return copied
+	case []map[string]interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = redacted(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = redacted(item)
+		}
+		return copied
+	default:
+		return v
+	}
+}
+
 func main() {
 	defer func() {
 		libs.ReleaseLoggerModule()
@@ -31,16 +71,137 @@ func main() {
 	libs.InitGlobalLog()
 	libs.LoadLoggerModule(logLevel, logToFile, logFilePath, logErrorPath)
 
-	port := viper.GetInt("port")
-	httpsEnable := viper.GetBool("https_enable")
-	cert := viper.GetString("cert")
-	key := viper.GetString("key")
-	natsUrls := viper.GetStringSlice("nats_urls")
+	viper.SetDefault("read_buffer_size", 1024)
+	viper.SetDefault("write_buffer_size", 1024)
+	viper.SetDefault("nats.name", "dugon-signal-server")
+	viper.SetDefault("metadata.max_keys", 32)
+	viper.SetDefault("metadata.max_key_length", 64)
+	viper.SetDefault("metadata.max_value_length", 1024)
+	viper.SetDefault("metadata.max_bytes", 4096)
+	viper.SetDefault("attributes.max_keys", 64)
+	viper.SetDefault("attributes.max_key_length", 64)
+	viper.SetDefault("attributes.max_value_length", 1024)
+	viper.SetDefault("attributes.max_bytes", 16384)
+	viper.SetDefault("duplicate_token_policy", libs.DuplicateKick)
+	viper.SetDefault("token_api.default_ttl", 3600)
+	viper.SetDefault("token_api.max_ttl", 86400)
+	viper.SetDefault("idempotency_ttl", 300)
+	viper.SetDefault("max_message_data", 4096)
+	viper.SetDefault("default_permissions.can_publish", true)
+	viper.SetDefault("default_permissions.can_subscribe", true)
+	viper.SetDefault("default_permissions.can_publish_data", true)
+
+	wsConfig := libs.WsConfig{
+		Port:            viper.GetInt("port"),
+		HttpsEnable:     viper.GetBool("https_enable"),
+		Cert:            viper.GetString("cert"),
+		Key:             viper.GetString("key"),
+		AllowedOrigins:  viper.GetStringSlice("allowed_origins"),
+		AllowAllOrigins: viper.GetBool("allow_all_origins"),
+		ReadBufferSize:  viper.GetInt("read_buffer_size"),
+		WriteBufferSize: viper.GetInt("write_buffer_size"),
+		DefaultPermissions: libs.Permissions{
+			CanPublish:     viper.GetBool("default_permissions.can_publish"),
+			CanSubscribe:   viper.GetBool("default_permissions.can_subscribe"),
+			CanPublishData: viper.GetBool("default_permissions.can_publish_data"),
+			CanModerate:    viper.GetBool("default_permissions.can_moderate"),
+			Sources:        viper.GetStringSlice("default_permissions.sources"),
+		},
+	}
+	err = viper.UnmarshalKey("api_keys", &wsConfig.APIKeys)
+	if err != nil {
+		log.Fatalf("Fatal error api keys config: %s \n", err)
+	}
+	wsConfig.TokenAPI.DefaultTTL = time.Duration(viper.GetInt64("token_api.default_ttl")) * time.Second
+	wsConfig.TokenAPI.MaxTTL = time.Duration(viper.GetInt64("token_api.max_ttl")) * time.Second
+
+	groupConfig := libs.GroupConfig{}
+	groupConfig.Nats = libs.NatsConfig{
+		Urls:      viper.GetStringSlice("nats_urls"),
+		Name:      viper.GetString("nats.name"),
+		User:      viper.GetString("nats.user"),
+		Password:  viper.GetString("nats.password"),
+		Token:     viper.GetString("nats.token"),
+		NkeySeed:  viper.GetString("nats.nkey_seed"),
+		CredsFile: viper.GetString("nats.creds_file"),
+		TLSCa:     viper.GetString("nats.tls_ca"),
+		TLSCert:   viper.GetString("nats.tls_cert"),
+		TLSKey:    viper.GetString("nats.tls_key"),
+	}
+
+	groupConfig.RateLimit = libs.RateLimitConfig{
+		Enable: viper.GetBool("rate_limit.enable"),
+		Upgrade: libs.Limit{
+			Rate:  viper.GetFloat64("rate_limit.upgrade.rate"),
+			Burst: viper.GetInt("rate_limit.upgrade.burst"),
+		},
+		Request: libs.Limit{
+			Rate:  viper.GetFloat64("rate_limit.request.rate"),
+			Burst: viper.GetInt("rate_limit.request.burst"),
+		},
+		Broadcast: libs.Limit{
+			Rate:  viper.GetFloat64("rate_limit.broadcast.rate"),
+			Burst: viper.GetInt("rate_limit.broadcast.burst"),
+		},
+		MaxViolations: viper.GetInt("rate_limit.max_violations"),
+	}
+	err = viper.UnmarshalKey("rate_limit.events", &groupConfig.RateLimit.Events)
+	if err != nil {
+		log.Fatalf("Fatal error rate limit config: %s \n", err)
+	}
+
+	groupConfig.MediaAuth = libs.MediaAuthConfig{
+		Enable: viper.GetBool("media_auth.enable"),
+		Mode:   viper.GetString("media_auth.mode"),
+		Secret: viper.GetString("media_auth.secret"),
+	}
+	err = viper.UnmarshalKey("media_auth.keys", &groupConfig.MediaAuth.Keys)
+	if err != nil {
+		log.Fatalf("Fatal error media auth config: %s \n", err)
+	}
 
 	libs.Log.Infof("Compiled : %s ->", lastCompile)
-	libs.Log.Info("Config ->", viper.AllSettings())
+	libs.Log.Info("Config ->", redacted(viper.AllSettings()))
+
+	var auth *libs.Authenticator
+	if viper.GetBool("auth.enable") {
+		auth, err = libs.NewAuthenticator(libs.AuthConfig{
+			Algorithm:  viper.GetString("auth.algorithm"),
+			Secret:     viper.GetString("auth.secret"),
+			PublicKey:  viper.GetString("auth.public_key"),
+			PrivateKey: viper.GetString("auth.private_key"),
+		})
+		if err != nil {
+			log.Fatalf("Fatal error auth config: %s \n", err)
+		}
+	} else if viper.GetBool("auth.allow_unsigned_params") {
+		libs.Log.Warn("Auth is disabled, sessionId and tokenId are accepted unsigned, development only")
+	} else {
+		log.Fatalf("Fatal error auth config: auth is disabled and auth.allow_unsigned_params is not set \n")
+	}
+
+	groupConfig.Metadata = libs.MetadataConfig{
+		MaxKeys:           viper.GetInt("metadata.max_keys"),
+		MaxKeyLength:      viper.GetInt("metadata.max_key_length"),
+		MaxValueLength:    viper.GetInt("metadata.max_value_length"),
+		MaxBytes:          viper.GetInt("metadata.max_bytes"),
+		ParticipantSchema: viper.GetString("metadata.participant_schema"),
+		SenderSchema:      viper.GetString("metadata.sender_schema"),
+	}
+
+	groupConfig.Attributes = libs.AttributesConfig{
+		MaxKeys:        viper.GetInt("attributes.max_keys"),
+		MaxKeyLength:   viper.GetInt("attributes.max_key_length"),
+		MaxValueLength: viper.GetInt("attributes.max_value_length"),
+		MaxBytes:       viper.GetInt("attributes.max_bytes"),
+	}
+
+	groupConfig.DuplicatePolicy = viper.GetString("duplicate_token_policy")
+	groupConfig.DevMode = viper.GetBool("dev_mode")
+	groupConfig.IdempotencyTTL = time.Duration(viper.GetInt64("idempotency_ttl")) * time.Second
+	groupConfig.MaxMessageData = viper.GetInt("max_message_data")
 
-	clientGroup := libs.NewClientGroup(natsUrls)
+	clientGroup := libs.NewClientGroup(groupConfig)
 	go clientGroup.Run()
-	libs.InitWsServer(clientGroup, port, httpsEnable, cert, key)
+	libs.InitWsServer(clientGroup, auth, wsConfig)
 }